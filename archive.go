@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// -------------------- ARCHIVE FORMATS (tar.gz / tar.zst) --------------------
+//
+// Archives are written in PAX format so mtimes keep nanosecond precision, and
+// carry the same information copyDirContents preserves: permission bits, mtimes
+// and symlinks (as symlinks).
+
+const archiveBaseName = "data"
+
+func archivePathForDir(backupDir, format string) string {
+	return filepath.Join(backupDir, archiveBaseName+"."+format)
+}
+
+// createArchive writes the tree under srcDir (as selected by opts) into a
+// single compressed archive at dst.
+func createArchive(srcDir, dst, format string, opts copyOptions) (err error) {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("write archive: %w", cerr)
+		}
+	}()
+
+	var sink io.Writer = f
+	var sw io.WriteCloser
+	if opts.key != nil {
+		if sw, err = newSealWriter(f, opts.key); err != nil {
+			return fmt.Errorf("write archive: %w", err)
+		}
+		sink = sw
+	}
+	zw, err := newCompressor(sink, format)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+
+	walkErr := walkSource(srcDir, opts, func(path, rel string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+			Format:  tar.FormatPAX,
+		}
+		e := newManifestEntry(rel, info)
+
+		switch {
+		case d.Type()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = target
+			e.Link = target
+		case d.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case info.Mode().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = info.Size()
+		default:
+			// Sockets, devices, fifos: not backed up.
+			return nil
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			in, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			h := sha256.New()
+			if _, err := io.Copy(io.MultiWriter(tw, h), in); err != nil {
+				return err
+			}
+			e.SHA256 = hexSum(h)
+		}
+		opts.record.add(e)
+		return nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+	if sw != nil {
+		if err := sw.Close(); err != nil {
+			return fmt.Errorf("write archive: %w", err)
+		}
+	}
+	return nil
+}
+
+// extractArchive unpacks an archive written by createArchive into dstDir,
+// restoring permissions, mtimes and symlinks. key is nil unless it is sealed.
+func extractArchive(src, format, dstDir string, key *sealKey) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open archive: %w", err)
+	}
+	defer f.Close()
+
+	r, err := openArchiveStream(f, key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	zr, err := newDecompressor(r, format)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	type dirMeta struct {
+		path  string
+		mode  fs.FileMode
+		mtime time.Time
+	}
+	var dirs []dirMeta
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read archive %s: %w", src, err)
+		}
+
+		rel := strings.TrimSuffix(hdr.Name, "/")
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return fmt.Errorf("archive %s: refusing unsafe path %q", src, hdr.Name)
+		}
+		dstPath := filepath.Join(dstDir, filepath.FromSlash(rel))
+		mode := fs.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dstPath, mode|0o700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMeta{dstPath, mode, hdr.ModTime})
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+				return err
+			}
+			_ = os.RemoveAll(dstPath)
+			if err := os.Symlink(hdr.Linkname, dstPath); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+				return err
+			}
+			if err := writeFileFrom(dstPath, tr, mode); err != nil {
+				return fmt.Errorf("extract %s: %w", rel, err)
+			}
+			_ = os.Chtimes(dstPath, time.Now(), hdr.ModTime)
+		default:
+			// Not produced by createArchive; skip.
+		}
+	}
+
+	// Directory modes and mtimes last (deepest first), after their children exist.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Chmod(dirs[i].path, dirs[i].mode)
+		_ = os.Chtimes(dirs[i].path, time.Now(), dirs[i].mtime)
+	}
+	return nil
+}
+
+// openArchiveStream unwraps a sealed archive; plaintext archives pass through.
+func openArchiveStream(f io.Reader, key *sealKey) (io.Reader, error) {
+	if key == nil {
+		return f, nil
+	}
+	return newSealReader(f, key)
+}
+
+func writeFileFrom(dst string, r io.Reader, mode fs.FileMode) error {
+	_ = os.RemoveAll(dst)
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func newCompressor(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case formatTarGz:
+		return gzip.NewWriter(w), nil
+	case formatTarZst:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("not an archive format: %q", format)
+}
+
+func newDecompressor(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case formatTarGz:
+		return gzip.NewReader(r)
+	case formatTarZst:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("not an archive format: %q", format)
+}
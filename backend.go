@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// -------------------- STORAGE BACKENDS --------------------
+//
+// A Backend stores objects under slash-separated keys relative to the backup
+// root ("api_backup/api_3/.bkup_meta.json", "objects/ab/ab12..."). The local
+// backend is the backup root itself. Other backends ("backend" in config.json)
+// hold an off-machine copy: the local root then acts as a working cache, and
+// bkup uploads every new version, deletes what it deletes locally, lists
+// versions that only exist remotely and downloads them when they are used.
+
+type Backend interface {
+	Put(key string, r io.Reader, size int64) error
+	Get(key string) (io.ReadCloser, error) // fs.ErrNotExist if missing
+	List(prefix string) ([]ObjectInfo, error)
+	Delete(key string) error // deleting a missing key is not an error
+	Stat(key string) (ObjectInfo, error)
+	String() string // location for messages, e.g. s3://bucket/prefix
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// localPather is implemented by backends whose objects are plain files, so
+// callers can work on them in place.
+type localPather interface {
+	LocalPath(key string) string
+}
+
+// BackendConfig is the "backend" block of config.json.
+type BackendConfig struct {
+	Type string `json:"type"` // "local" (default) or "s3"
+
+	// s3
+	Endpoint        string `json:"endpoint,omitempty"` // default https://s3.<region>.amazonaws.com
+	Region          string `json:"region,omitempty"`   // default us-east-1
+	Bucket          string `json:"bucket,omitempty"`
+	Prefix          string `json:"prefix,omitempty"`            // key prefix inside the bucket
+	PathStyle       bool   `json:"path_style,omitempty"`        // http://host/bucket/key (MinIO) instead of http://bucket.host/key
+	AccessKeyID     string `json:"access_key_id,omitempty"`     // default $AWS_ACCESS_KEY_ID
+	SecretAccessKey string `json:"secret_access_key,omitempty"` // default $AWS_SECRET_ACCESS_KEY
+}
+
+func openBackend(c *BackendConfig, backupRoot string) (Backend, error) {
+	if c == nil {
+		return &localBackend{root: backupRoot}, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(c.Type)) {
+	case "", "local":
+		return &localBackend{root: backupRoot}, nil
+	case "s3":
+		return newS3Backend(c)
+	}
+	return nil, fmt.Errorf("unknown backend type %q (expected local or s3)", c.Type)
+}
+
+// validateBackend checks c without connecting: its type and the settings that
+// type requires. key names the setting in messages.
+func validateBackend(key string, c *BackendConfig) error {
+	if c == nil {
+		return nil
+	}
+	switch strings.ToLower(strings.TrimSpace(c.Type)) {
+	case "", "local":
+		return nil
+	case "s3":
+		if c.Bucket == "" {
+			return fmt.Errorf("%s.bucket is required for s3", key)
+		}
+		if _, err := s3Endpoint(c); err != nil {
+			return fmt.Errorf("%s.%w", key, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s.type: unknown backend type %q (expected local or s3)", key, c.Type)
+}
+
+// remotes maps a local backup root to the off-machine backend that mirrors it.
+// Roots without an entry are purely local.
+var remotes = map[string]Backend{}
+
+// attachBackend opens cfg's backend for backupRoot and registers it unless it
+// is the local root itself.
+func attachBackend(backupRoot string, c *BackendConfig) error {
+	be, err := openBackend(c, backupRoot)
+	if err != nil {
+		return err
+	}
+	if _, local := be.(*localBackend); !local {
+		remotes[backupRoot] = be
+	}
+	return nil
+}
+
+func remoteFor(backupRoot string) Backend { return remotes[backupRoot] }
+
+// -------------------- LOCAL BACKEND --------------------
+
+type localBackend struct {
+	root string
+}
+
+func (b *localBackend) String() string { return b.root }
+
+func (b *localBackend) LocalPath(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(key))
+}
+
+func (b *localBackend) Put(key string, r io.Reader, size int64) error {
+	p := b.LocalPath(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write %s: %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (b *localBackend) Get(key string) (io.ReadCloser, error) {
+	return os.Open(b.LocalPath(key))
+}
+
+// List returns the regular files whose keys start with prefix, sorted by key.
+func (b *localBackend) List(prefix string) ([]ObjectInfo, error) {
+	dir := b.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = b.LocalPath(prefix[:i])
+	}
+	var out []ObjectInfo
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		out = append(out, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, err
+}
+
+func (b *localBackend) Delete(key string) error {
+	err := os.Remove(b.LocalPath(key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b *localBackend) Stat(key string) (ObjectInfo, error) {
+	info, err := os.Stat(b.LocalPath(key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// -------------------- KEY HELPERS --------------------
+
+// backendKey returns the key of a local path under backupRoot.
+func backendKey(backupRoot, p string) (string, error) {
+	rel, err := filepath.Rel(backupRoot, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not inside %s", p, backupRoot)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// slotRoot returns the backup root a slot dir (<root>/<project>_backup/<slot>) belongs to.
+func slotRoot(slotDir string) string {
+	return filepath.Dir(filepath.Dir(slotDir))
+}
+
+// copyObject copies one object between backends.
+func copyObject(dst, src Backend, key string) error {
+	info, err := src.Stat(key)
+	if err != nil {
+		return err
+	}
+	r, err := src.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := dst.Put(key, r, info.Size); err != nil {
+		return fmt.Errorf("copy %s to %s: %w", key, dst, err)
+	}
+	return nil
+}
+
+// deletePrefix deletes every object under prefix (a "dir/" key prefix).
+// Meta files go first, so an interrupted delete never leaves a version that
+// looks complete but is missing data.
+func deletePrefix(be Backend, prefix string) error {
+	objs, err := be.List(prefix)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		return path.Base(objs[i].Key) == metaFileName && path.Base(objs[j].Key) != metaFileName
+	})
+	for _, o := range objs {
+		if err := be.Delete(o.Key); err != nil {
+			return fmt.Errorf("delete %s from %s: %w", o.Key, be, err)
+		}
+	}
+	return nil
+}
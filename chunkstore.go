@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const objectsDirName = "objects"
+
+// -------------------- CONTENT-DEFINED CHUNKING --------------------
+//
+// Chunk boundaries come from a gear rolling hash (as in FastCDC), so an insert
+// near the start of a file only changes the chunks around the edit, and equal
+// content in different files/projects produces equal chunks.
+
+const (
+	chunkMin  = 8 << 10
+	chunkMax  = 128 << 10
+	chunkMask = (1 << 15) - 1 // ~32 KiB average past chunkMin
+)
+
+var gearTable = func() [256]uint64 {
+	// splitmix64 with a fixed seed: the table must never change, or
+	// chunk boundaries (and therefore deduplication) would shift.
+	var t [256]uint64
+	x := uint64(0x62_6b_75_70) // "bkup"
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// cdcCut returns the length of the first chunk in data.
+func cdcCut(data []byte) int {
+	n := len(data)
+	if n <= chunkMin {
+		return n
+	}
+	if n > chunkMax {
+		n = chunkMax
+	}
+	var h uint64
+	for i := chunkMin; i < n; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// splitChunks reads r to EOF and calls fn for every chunk. The slice passed
+// to fn is only valid for the duration of the call.
+func splitChunks(r io.Reader, fn func(chunk []byte) error) error {
+	buf := make([]byte, 2*chunkMax)
+	start, end := 0, 0
+	eof := false
+	for {
+		// Keep at least chunkMax bytes buffered unless the input is exhausted.
+		if !eof && end-start < chunkMax {
+			if start > 0 {
+				end = copy(buf, buf[start:end])
+				start = 0
+			}
+			for end < len(buf) && !eof {
+				n, err := r.Read(buf[end:])
+				end += n
+				if err == io.EOF {
+					eof = true
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		if start == end {
+			return nil
+		}
+		cut := cdcCut(buf[start:end])
+		if err := fn(buf[start : start+cut]); err != nil {
+			return err
+		}
+		start += cut
+	}
+}
+
+// -------------------- OBJECT STORE --------------------
+
+func objectsDir(backupRoot string) string {
+	return filepath.Join(backupRoot, objectsDirName)
+}
+
+func objectPath(objDir, id string) string {
+	return filepath.Join(objDir, id[:2], id)
+}
+
+// putObject stores data under its id unless it is already present: its SHA-256,
+// or, with a key, its HMAC (the object itself is then sealed).
+func putObject(objDir string, data []byte, key *sealKey) (string, error) {
+	id := key.objectID(data)
+	p := objectPath(objDir, id)
+	if _, err := os.Stat(p); err == nil {
+		return id, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return "", fmt.Errorf("create object dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("create object temp: %w", err)
+	}
+	if key != nil {
+		data = key.sealBlob(data)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("write object: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("write object: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("store object: %w", err)
+	}
+	return id, nil
+}
+
+// storeChunkedTree chunks every file under srcDir selected by opts into objDir,
+// recording the chunk ids of each file in opts.record.
+func storeChunkedTree(srcDir, objDir string, opts copyOptions) error {
+	return walkSource(srcDir, opts, func(path, rel string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := newManifestEntry(rel, info)
+
+		switch {
+		case d.Type()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			e.Link = target
+		case d.IsDir():
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			h := sha256.New()
+			err = splitChunks(f, func(chunk []byte) error {
+				h.Write(chunk)
+				id, err := putObject(objDir, chunk, opts.key)
+				if err != nil {
+					return err
+				}
+				e.Chunks = append(e.Chunks, id)
+				return nil
+			})
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("chunk %s: %w", path, err)
+			}
+			e.SHA256 = hexSum(h)
+		default:
+			// Sockets, devices, fifos: not backed up.
+			return nil
+		}
+
+		opts.record.add(e)
+		return nil
+	})
+}
+
+// restoreChunkedTree rebuilds the tree described by m into dstDir.
+func restoreChunkedTree(m Manifest, objDir, dstDir string, key *sealKey) error {
+	for _, e := range m.Entries {
+		dstPath := filepath.Join(dstDir, filepath.FromSlash(e.Path))
+		mode := fs.FileMode(e.Mode).Perm()
+
+		switch e.Type {
+		case entryDir:
+			if err := os.MkdirAll(dstPath, mode|0o700); err != nil {
+				return err
+			}
+		case entrySymlink:
+			if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+				return err
+			}
+			_ = os.RemoveAll(dstPath)
+			if err := os.Symlink(e.Link, dstPath); err != nil {
+				return err
+			}
+		case entryFile:
+			if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+				return err
+			}
+			if err := writeChunkedFile(objDir, e, dstPath, mode, key); err != nil {
+				return fmt.Errorf("restore %s: %w", e.Path, err)
+			}
+			_ = os.Chtimes(dstPath, time.Now(), time.Unix(0, e.MTimeNs))
+		default:
+			return fmt.Errorf("manifest entry %s: unknown type %q", e.Path, e.Type)
+		}
+	}
+
+	// Directory modes and mtimes last (deepest first), after their children exist.
+	for i := len(m.Entries) - 1; i >= 0; i-- {
+		e := m.Entries[i]
+		if e.Type != entryDir {
+			continue
+		}
+		dstPath := filepath.Join(dstDir, filepath.FromSlash(e.Path))
+		_ = os.Chmod(dstPath, fs.FileMode(e.Mode).Perm())
+		_ = os.Chtimes(dstPath, time.Now(), time.Unix(0, e.MTimeNs))
+	}
+	return nil
+}
+
+func writeChunkedFile(objDir string, e ManifestEntry, dstPath string, mode fs.FileMode, key *sealKey) error {
+	_ = os.RemoveAll(dstPath)
+	out, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+
+	for _, id := range e.Chunks {
+		data, err := readObject(objDir, id, key)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// readObject loads (and with a key, opens) one object.
+func readObject(objDir, id string, key *sealKey) ([]byte, error) {
+	data, err := os.ReadFile(objectPath(objDir, id))
+	if err != nil {
+		return nil, fmt.Errorf("missing object %s: %w", id, err)
+	}
+	if key != nil {
+		if data, err = key.openBlob(data); err != nil {
+			return nil, fmt.Errorf("object %s: %w", id, err)
+		}
+	}
+	return data, nil
+}
+
+// writeObjectList records the object ids a version uses in plaintext, so gc can
+// keep them without unsealing its manifest.
+func writeObjectList(backupDir string, m Manifest) error {
+	seen := map[string]bool{}
+	var b strings.Builder
+	for _, e := range m.Entries {
+		for _, id := range e.Chunks {
+			if !seen[id] {
+				seen[id] = true
+				b.WriteString(id + "\n")
+			}
+		}
+	}
+	if err := os.WriteFile(filepath.Join(backupDir, objectListFileName), []byte(b.String()), 0o600); err != nil {
+		return fmt.Errorf("write object list: %w", err)
+	}
+	return nil
+}
+
+// -------------------- GC --------------------
+
+// gcObjects deletes every object under backupRoot/objects that is not referenced
+// by a manifest of any project. Returns the number of objects and bytes removed.
+func gcObjects(backupRoot string) (int, int64, error) {
+	objDir := objectsDir(backupRoot)
+	if _, err := os.Stat(objDir); os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+
+	referenced, err := referencedObjects(backupRoot)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed := 0
+	var freed int64
+	err = filepath.WalkDir(objDir, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		if referenced[name] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("remove %s: %w", path, err)
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return removed, freed, err
+	}
+
+	// Drop now-empty fan-out dirs.
+	if ents, err := os.ReadDir(objDir); err == nil {
+		for _, e := range ents {
+			if e.IsDir() {
+				_ = os.Remove(filepath.Join(objDir, e.Name()))
+			}
+		}
+	}
+	return removed, freed, nil
+}
+
+// referencedObjects collects object ids from every manifest in every slot under
+// backupRoot/<project>_backup/. Sealed manifests cannot be read without the key,
+// so encrypted chunked versions list their ids in a plaintext .bkup_objects
+// file; encrypted archives reference no chunks.
+func referencedObjects(backupRoot string) (map[string]bool, error) {
+	out := map[string]bool{}
+	projects, err := os.ReadDir(backupRoot)
+	if err != nil {
+		return nil, fmt.Errorf("read backup root: %w", err)
+	}
+	for _, p := range projects {
+		if !p.IsDir() || !strings.HasSuffix(p.Name(), "_backup") {
+			continue
+		}
+		projectRoot := filepath.Join(backupRoot, p.Name())
+		slots, err := os.ReadDir(projectRoot)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", projectRoot, err)
+		}
+		for _, s := range slots {
+			if !s.IsDir() {
+				continue
+			}
+			slot := filepath.Join(projectRoot, s.Name())
+			if b, err := os.ReadFile(filepath.Join(slot, objectListFileName)); err == nil {
+				for _, id := range strings.Fields(string(b)) {
+					out[id] = true
+				}
+				continue
+			}
+			if _, err := os.Stat(manifestPathForDir(slot)); err != nil {
+				continue
+			}
+			m, err := readManifest(slot, nil)
+			if errors.Is(err, errSealed) {
+				continue // an encrypted archive: no object list, no chunks
+			}
+			if err != nil {
+				// Refuse to collect anything we cannot prove is unreferenced.
+				return nil, err
+			}
+			for _, e := range m.Entries {
+				for _, id := range e.Chunks {
+					out[id] = true
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// gcBackendObjects is gcObjects for a remote backend: it deletes objects/ keys
+// that no slot stored there references. Run it while no other machine is
+// uploading, since chunks go up before the manifest that references them.
+func gcBackendObjects(be Backend) (int, int64, error) {
+	all, err := be.List("")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Per slot: its object list if it has one, else its manifest.
+	refs := map[string]string{}
+	for _, o := range all {
+		parts := strings.Split(o.Key, "/")
+		if len(parts) != 3 || !strings.HasSuffix(parts[0], "_backup") {
+			continue
+		}
+		slot := parts[0] + "/" + parts[1]
+		switch parts[2] {
+		case objectListFileName:
+			refs[slot] = o.Key
+		case manifestFileName:
+			if refs[slot] == "" {
+				refs[slot] = o.Key
+			}
+		}
+	}
+	referenced := map[string]bool{}
+	for _, key := range refs {
+		b, err := readAllObject(be, key)
+		if err != nil {
+			return 0, 0, fmt.Errorf("read %s: %w", key, err)
+		}
+		if path.Base(key) == objectListFileName {
+			for _, id := range strings.Fields(string(b)) {
+				referenced[id] = true
+			}
+			continue
+		}
+		m, err := parseManifest(b, nil, be.String()+"/"+key)
+		if err != nil {
+			if errors.Is(err, errSealed) {
+				continue // a sealed archive's manifest: archives have no chunks
+			}
+			// Refuse to collect anything we cannot prove is unreferenced.
+			return 0, 0, err
+		}
+		for _, e := range m.Entries {
+			for _, id := range e.Chunks {
+				referenced[id] = true
+			}
+		}
+	}
+
+	removed := 0
+	var freed int64
+	for _, o := range all {
+		if !strings.HasPrefix(o.Key, objectsDirName+"/") || referenced[path.Base(o.Key)] {
+			continue
+		}
+		if err := be.Delete(o.Key); err != nil {
+			return removed, freed, fmt.Errorf("delete %s from %s: %w", o.Key, be, err)
+		}
+		removed++
+		freed += o.Size
+	}
+	return removed, freed, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// TestGCWithSealedArchive checks that an encrypted archive version (a sealed
+// manifest and no object list) does not stop gc from collecting chunks.
+func TestGCWithSealedArchive(t *testing.T) {
+	t.Setenv("BKUP_PASSPHRASE", "correct horse battery staple")
+	src, root := t.TempDir(), t.TempDir()
+	writeFiles(t, src, map[string]string{"a.txt": "alpha\n", "b.txt": "bravo\n"})
+
+	chunked := Config{MaxVersions: -1, Format: formatChunked}
+	if _, err := backupNewVersion(src, root, chunked, backupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sealed := Config{MaxVersions: -1, Encryption: &EncryptionConfig{Enabled: true}}
+	if _, err := backupNewVersion(src, root, sealed, backupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stray := filepath.Join(objectsDir(root), "ff", "ff00")
+	writeFiles(t, filepath.Dir(stray), map[string]string{"ff00": "unreferenced"})
+	removed, _, err := gcObjects(root)
+	if err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("gc removed %d object(s), want only the unreferenced one", removed)
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("unreferenced object survived gc: %v", err)
+	}
+}
+
+// chunksOf splits data and returns copies of the chunks.
+func chunksOf(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	var out []string
+	if err := splitChunks(r, func(c []byte) error { out = append(out, string(c)); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestSplitChunks(t *testing.T) {
+	data := make([]byte, 2<<20)
+	_, _ = rand.NewChaCha8([32]byte{}).Read(data)
+
+	chunks := chunksOf(t, bytes.NewReader(data))
+	if got := strings.Join(chunks, ""); got != string(data) {
+		t.Fatal("chunks do not add up to the input")
+	}
+	for i, c := range chunks {
+		if len(c) > chunkMax || len(c) <= chunkMin && i < len(chunks)-1 {
+			t.Errorf("chunk %d is %d bytes, want (%d, %d]", i, len(c), chunkMin, chunkMax)
+		}
+	}
+	if len(chunks) < 2<<20/chunkMax*2 {
+		t.Errorf("%d chunks for 2 MiB: boundaries are not content-defined", len(chunks))
+	}
+
+	// Boundaries depend on the content only, not on how it is read.
+	if got := chunksOf(t, iotest.HalfReader(bytes.NewReader(data))); !reflect.DeepEqual(got, chunks) {
+		t.Error("chunks differ when the input arrives in small reads")
+	}
+
+	// An insert near the start only changes the chunks around it.
+	edited := append(append(append([]byte{}, data[:1000]...), "inserted"...), data[1000:]...)
+	seen := map[string]bool{}
+	for _, c := range chunks {
+		seen[c] = true
+	}
+	changed := 0
+	for _, c := range chunksOf(t, bytes.NewReader(edited)) {
+		if !seen[c] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("an 8-byte insert changed %d of %d chunks", changed, len(chunks))
+	}
+
+	for _, n := range []int{0, 1, chunkMin} {
+		if got := chunksOf(t, bytes.NewReader(data[:n])); len(got) != min(n, 1) {
+			t.Errorf("%d bytes split into %d chunks", n, len(got))
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- COMMAND LINE --------------------
+//
+// Every subcommand is an entry in commands with its own flag.FlagSet, built
+// from the shared flagDefs plus the global flags (--root, --store, --project,
+// --wait, --no-wait). Flags may come before or after positional arguments, "--" ends
+// them, and unknown flags or a wrong number of arguments are usage errors
+// (exit 2). Without a subcommand, bkup backs up the current directory, so
+// flags before the first positional argument belong to the command it names
+// (e.g. `bkup -q` and `bkup -q pull 3` both work).
+
+// options holds every flag; each command's FlagSet only defines its own.
+type options struct {
+	root    string
+	store   string
+	project string
+	wait    bool
+	noWait  bool
+
+	queue     bool
+	message   string
+	jobs      int
+	force     bool
+	print     bool
+	grep      string
+	patch     bool
+	all       bool
+	olderThan time.Duration
+	keepLast  int
+	maxSize   int64
+	dryRun    bool
+	effective bool
+
+	given map[string]bool // flags set on the command line (-q=false included)
+}
+
+type flagDef struct {
+	name   string
+	arg    string // value placeholder in help ("" for booleans)
+	help   string
+	define func(fs *flag.FlagSet, o *options)
+}
+
+var globalFlags = []string{"root", "store", "project", "wait", "no-wait"}
+
+var flagDefs = []flagDef{
+	{"root", "dir", "use dir as the backup root (default: $BKUP_ROOT, stores.default, the data dir)",
+		func(fs *flag.FlagSet, o *options) { fs.StringVar(&o.root, "root", "", "") }},
+	{"store", "name", "use the backup root named name in the \"stores\" map of config.json",
+		func(fs *flag.FlagSet, o *options) { fs.StringVar(&o.store, "store", "", "") }},
+	{"project", "dir|name", "act on this project (its source dir or project name) instead of the current one",
+		func(fs *flag.FlagSet, o *options) { fs.StringVar(&o.project, "project", "", "") }},
+	{"wait", "", "wait for another bkup holding the lock (default)",
+		func(fs *flag.FlagSet, o *options) { fs.BoolVar(&o.wait, "wait", false, "") }},
+	{"no-wait", "", "fail at once if another bkup holds the lock",
+		func(fs *flag.FlagSet, o *options) { fs.BoolVar(&o.noWait, "no-wait", false, "") }},
+
+	{"q", "", "queue mode: overwrite the oldest unpinned backup when max_versions is reached",
+		func(fs *flag.FlagSet, o *options) { fs.BoolVar(&o.queue, "q", false, "") }},
+	{"m", "message", "store a message with the new backup",
+		func(fs *flag.FlagSet, o *options) { fs.StringVar(&o.message, "m", "", "") }},
+	{"jobs", "n", "copy up to n files at once (default: copy_workers, else 8)",
+		func(fs *flag.FlagSet, o *options) { fs.Var(positiveInt{&o.jobs}, "jobs", "") }},
+	{"force", "", "allow backing up /, $HOME or a filesystem root",
+		func(fs *flag.FlagSet, o *options) { fs.BoolVar(&o.force, "force", false, "") }},
+	{"print", "", "print the path instead of opening a subshell",
+		func(fs *flag.FlagSet, o *options) { fs.BoolVar(&o.print, "print", false, "") }},
+	{"grep", "pattern", "only backups whose message matches (case-insensitive regexp)",
+		func(fs *flag.FlagSet, o *options) { fs.StringVar(&o.grep, "grep", "", "") }},
+	{"patch", "", "also print unified diffs for text files",
+		func(fs *flag.FlagSet, o *options) { fs.BoolVar(&o.patch, "patch", false, "") }},
+	{"all", "", "every backup of the project",
+		func(fs *flag.FlagSet, o *options) { fs.BoolVar(&o.all, "all", false, "") }},
+	{"older-than", "age", "backups created more than age ago (e.g. 36h, 14d, 2w)",
+		func(fs *flag.FlagSet, o *options) { fs.Var(ageValue{&o.olderThan}, "older-than", "") }},
+	{"keep-last", "n", "never delete the newest n backups",
+		func(fs *flag.FlagSet, o *options) { fs.Var(countValue{&o.keepLast}, "keep-last", "") }},
+	{"max-size", "size", "delete oldest first until the project uses at most size (e.g. 2G)",
+		func(fs *flag.FlagSet, o *options) { fs.Var(sizeValue{&o.maxSize}, "max-size", "") }},
+	{"dry-run", "", "only print what would be deleted",
+		func(fs *flag.FlagSet, o *options) { fs.BoolVar(&o.dryRun, "dry-run", false, "") }},
+	{"effective", "", "merge in the project config and show where each value comes from",
+		func(fs *flag.FlagSet, o *options) { fs.BoolVar(&o.effective, "effective", false, "") }},
+}
+
+func findFlagDef(name string) flagDef {
+	for _, d := range flagDefs {
+		if d.name == name {
+			return d
+		}
+	}
+	panic("unknown flag " + name)
+}
+
+// positiveInt is an int flag that must be at least 1.
+type positiveInt struct{ p *int }
+
+func (v positiveInt) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v positiveInt) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return errors.New("expected a positive number")
+	}
+	*v.p = n
+	return nil
+}
+
+// countValue is an int flag that must not be negative (unset stays -1).
+type countValue struct{ p *int }
+
+func (v countValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v countValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return errors.New("expected a number of backups")
+	}
+	*v.p = n
+	return nil
+}
+
+type ageValue struct{ p *time.Duration }
+
+func (v ageValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return v.p.String()
+}
+
+func (v ageValue) Set(s string) (err error) {
+	*v.p, err = parseAge(s)
+	return err
+}
+
+type sizeValue struct{ p *int64 }
+
+func (v sizeValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.FormatInt(*v.p, 10)
+}
+
+func (v sizeValue) Set(s string) (err error) {
+	*v.p, err = parseSize(s)
+	return err
+}
+
+// -------------------- COMMANDS --------------------
+
+type command struct {
+	names   []string // the first is shown in help; the rest share it (pin/unpin)
+	usage   []string // synopsis lines, without "bkup "
+	minArgs int
+	maxArgs int // -1: no limit
+	flags   []string
+	help    string
+	run     func(e *env, args []string) error
+}
+
+// commands is in help order. The first entry runs when no subcommand is given.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{names: []string{"backup"}, usage: []string{"[-q] [-m message] [--force]"}, maxArgs: 0,
+			flags: []string{"q", "m", "jobs", "force"}, run: cmdBackup, help: `
+Create a new versioned backup of the current directory:
+<backup root>/<dirname>_backup/<dirname>_<N>
+(default root: ~/.local/share/bkup, or $HOME/.bkup on macOS and Windows)
+With -m: store a message with it (e.g. -m "before auth refactor").
+The backup root, the default root and every store are never copied, even when
+they are inside the current directory.
+Backing up /, $HOME or the root of a mounted filesystem is refused (with an
+estimate of its size) unless --force is given; the same goes for go, pull and
+watch, which back up the current directory too.
+A .bkup.json or .bkup.toml in the directory can set the project's own name,
+max_versions, format, ignore patterns and hooks, and make -q the default
+(see bkup config show --effective).`},
+
+		{names: []string{"go"}, usage: []string{"go [number|tag] [--print]"}, maxArgs: 1,
+			flags: []string{"print", "q", "m", "jobs", "force"}, run: cmdGo, help: `
+Go to the newest existing backup for the current project (does NOT create a new backup),
+or to the backup with the given number or tag.
+If no backups exist yet, it creates the first one.
+"Newest" is determined by <backup>/.bkup_meta.json timestamps.
+With --print: just print the backup directory path.`},
+
+		{names: []string{"revert"}, usage: []string{"revert [--print]"}, maxArgs: 0,
+			flags: []string{"print"}, run: cmdRevert, help: `
+Open a subshell in prev_path, saved by the last go in state.json.
+With --print: just print the prev_path.`},
+
+		{names: []string{"list"}, usage: []string{"list [--grep pattern]"}, maxArgs: 0,
+			flags: []string{"grep"}, run: cmdList, help: `
+List all backups for the current project: number, creation time, path and message.
+With --grep: only backups whose message matches (case-insensitive regexp).`},
+
+		{names: []string{"note"}, usage: []string{"note <number|tag> [text...]"}, minArgs: 1, maxArgs: -1,
+			run: cmdNote, help: `
+Set the message of a backup after the fact. Without text, clears it.`},
+
+		{names: []string{"pin", "unpin"}, usage: []string{"pin <number|tag>", "unpin <number|tag>"}, minArgs: 1, maxArgs: 1,
+			run: cmdPin, help: `
+Pinned backups are never overwritten by -q (FIFO), retention or prune. They still
+take up a slot, so at most max_pinned backups can be pinned or tagged (default and
+ceiling: max_versions-1).`},
+
+		{names: []string{"tag"}, usage: []string{"tag <number|tag> <name>"}, minArgs: 2, maxArgs: 2,
+			run: cmdTag, help: `
+Give a backup a name (e.g. "known-good"). A tag can be used anywhere a backup
+number is accepted (go, pull, restore, diff, verify, note, pin). Each tag names
+one backup per project. Tagged backups are kept like pinned ones and count
+against max_pinned.`},
+
+		{names: []string{"untag"}, usage: []string{"untag <name>"}, minArgs: 1, maxArgs: 1,
+			run: cmdUntag, help: `
+Remove a tag from the backup it names.`},
+
+		{names: []string{"diff"}, usage: []string{"diff [a] [b] [--patch]"}, maxArgs: 2,
+			flags: []string{"patch"}, run: cmdDiff, help: `
+Show what changed, with size deltas:
+  bkup diff          newest backup -> current directory
+  bkup diff <a>      backup <a>    -> current directory
+  bkup diff <a> <b>  backup <a>    -> backup <b>
+A = only on the right, D = only on the left, M = modified. Ignored paths are skipped.
+With --patch: also print unified diffs for text files ("Binary files ... differ" otherwise).`},
+
+		{names: []string{"watch"}, usage: []string{"watch [-q] [-m message]"}, maxArgs: 0,
+			flags: []string{"q", "m", "jobs", "force"}, run: cmdWatch, help: `
+Keep running and back up the current directory automatically: once changes stop
+for watch.quiet (default 5s), and at most once per watch.min_interval (default 1m).
+Uses inotify on Linux and polling elsewhere (every watch.poll, default 2s). Ignored
+paths don't count as changes, and nothing is backed up if the directory still
+matches the newest backup. Backups get the message "auto (bkup watch)" unless -m
+is given; with -q the oldest unpinned backup is overwritten when full (otherwise
+watch reports the error and keeps going). Stop with Ctrl-C.`},
+
+		{names: []string{"pull"}, usage: []string{"pull [number|tag] [-q]"}, maxArgs: 1,
+			flags: []string{"q", "jobs", "force"}, run: cmdPull, help: `
+Safety-backup the current directory (so you can undo), then replace the current
+directory contents with the chosen backup version. If no number is provided,
+the newest backup is used. Your current path stays the same.
+The replacement is all-or-nothing: the backup is copied next to your files first,
+then swapped in by renames; if anything fails, the original contents are moved
+back and the error says so.
+- Default: refuses if max_versions is reached (to avoid data loss).
+- With -q: overwrites the oldest backup (FIFO) to make room.`},
+
+		{names: []string{"restore"}, usage: []string{"restore <number|tag> <path>... [-q]"}, minArgs: 2, maxArgs: -1,
+			flags: []string{"q", "jobs"}, run: cmdRestore, help: `
+Restore only the named files or directories (globs allowed, e.g. 'src/**/*.go')
+from a backup into the current directory. The affected paths are safety-backed up
+first (just those paths); everything else is left alone. The selection ends up
+exactly as in the backup: selected paths missing from the backup are removed
+(they are kept in the safety backup). Ignored paths are never touched.
+The safety backup is a partial version: list marks it, and pull, go, diff
+and verify never pick it as the newest backup.`},
+
+		{names: []string{"clean"}, usage: []string{"clean"}, maxArgs: 0,
+			run: cmdClean, help: `
+Delete all backups for the current project only.`},
+
+		{names: []string{"cleanse"}, usage: []string{"cleanse"}, maxArgs: 0,
+			run: cmdCleanse, help: `
+Delete everything in the backup root (--root/--store select which one) except
+the keyring and the lock files (and config.json and state.json if they are there).`},
+
+		{names: []string{"prune"}, usage: []string{"prune [--older-than age] [--keep-last n] [--max-size size] [--dry-run]"}, maxArgs: 0,
+			flags: []string{"older-than", "keep-last", "max-size", "dry-run"}, run: cmdPrune, help: `
+Delete some backups of the current project:
+  --older-than 14d   backups created more than 14 days ago (also h, w: 36h, 2w)
+  --keep-last 3      never delete the newest 3 (alone: delete all older ones)
+  --max-size 2G      delete oldest first until the project uses at most 2 GiB
+Prints each deletion with the space it frees (hard-linked files shared with a
+kept backup free nothing). Pinned and tagged backups are never pruned.
+With --dry-run: only print the plan.`},
+
+		{names: []string{"gc"}, usage: []string{"gc"}, maxArgs: 0,
+			run: cmdGC, help: `
+Delete chunk objects in <backup root>/objects that no backup references anymore
+(run after clean, cleanse or -q overwrites when using "format": "chunked").
+With an s3 backend, unreferenced remote objects are deleted too (don't run it
+while another machine is uploading to the same bucket).`},
+
+		{names: []string{"verify"}, usage: []string{"verify [number|tag|--all]"}, maxArgs: 1,
+			flags: []string{"all"}, run: cmdVerify, help: `
+Check a backup (default: newest; --all: every backup of this project) against the
+SHA-256 manifest written when it was created. Reports missing, extra and corrupted
+files and exits non-zero if any are found.`},
+
+		{names: []string{"rekey"}, usage: []string{"rekey"}, maxArgs: 0,
+			run: cmdRekey, help: `
+Change the encryption passphrase. Only the key in <backup root>/keyring.json is
+rewrapped; existing backups are not re-encrypted. The new passphrase comes from
+$BKUP_NEW_PASSPHRASE or a prompt (update your keyfile afterwards if you use one).`},
+
+		{names: []string{"config"}, usage: []string{"config", "config show [--effective]", "config get <key>",
+			"config set <key> <value>", "config unset <key>", "config list", "config validate"}, maxArgs: 3,
+			flags: []string{"effective"}, run: cmdConfig, help: `
+Open config.json in $EDITOR (or vi / notepad): ~/.config/bkup/config.json
+($XDG_CONFIG_HOME/bkup), or $HOME/.bkup/config.json on macOS and Windows.
+When the editor exits the file is checked; if it is invalid you can edit it
+again, or keep the old config.json.
+show: print config.json. With --effective: print the settings for the current
+project, with .bkup.json / .bkup.toml merged in, and where each one comes from.
+get, set, unset: read or change one setting without an editor. Keys are dotted
+(max_versions, retention.keep_daily, stores.usb); values are checked against
+the setting's type, and lists may be JSON or comma-separated:
+  bkup config set retention.keep_daily 7
+  bkup config set ignore 'node_modules/,*.log'
+list: print every setting in config.json as key=value.
+validate: check config.json and the project's .bkup.json / .bkup.toml; exits 1
+on the first problem.`},
+
+		{names: []string{"help"}, usage: []string{"help [command]"}, maxArgs: 1,
+			run: cmdHelp, help: `
+Show help for all commands, or for one.`},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		for _, n := range c.names {
+			if n == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// flagSet builds c's FlagSet, writing into o.
+func (c *command) flagSet(o *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("bkup "+c.names[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	for _, name := range append(append([]string{}, c.flags...), globalFlags...) {
+		findFlagDef(name).define(fs, o)
+	}
+	return fs
+}
+
+// usageError is a bad command line; main prints it with a pointer to --help
+// and exits 2.
+type usageError struct {
+	cmd *command
+	err error
+}
+
+func (e *usageError) Error() string { return e.err.Error() }
+
+// invocation is a parsed command line.
+type invocation struct {
+	cmd  *command
+	name string // as typed (pin or unpin)
+	args []string
+	opts options
+	help bool // -h/--help was given
+}
+
+// parseCommandLine splits args into a command, its options and its
+// positional arguments.
+func parseCommandLine(args []string) (*invocation, error) {
+	inv := &invocation{opts: options{keepLast: -1}}
+
+	// Find the command: the first positional argument, once flags (which may
+	// take values) are skipped with every flag known. Then parse everything
+	// again with just the command's flags.
+	all := flag.NewFlagSet("bkup", flag.ContinueOnError)
+	all.SetOutput(io.Discard)
+	var scratch options
+	for _, d := range flagDefs {
+		d.define(all, &scratch)
+	}
+	err := all.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		inv.cmd, inv.help = findCommand("help"), true
+		return inv, nil
+	}
+	if err != nil {
+		return nil, &usageError{err: flagError(err, "")}
+	}
+	rest := all.Args()
+	named := len(rest) > 0 && !(len(args) > len(rest) && args[len(args)-len(rest)-1] == "--")
+	inv.cmd, inv.name = commands[0], commands[0].names[0]
+	if named {
+		if inv.cmd = findCommand(rest[0]); inv.cmd == nil {
+			return nil, &usageError{err: fmt.Errorf("unknown command %q", rest[0])}
+		}
+		inv.name = rest[0]
+	}
+
+	fs := inv.cmd.flagSet(&inv.opts)
+	inv.args, err = parseInterspersed(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		inv.help = true
+		return inv, nil
+	}
+	if err != nil {
+		return nil, &usageError{cmd: inv.cmd, err: flagError(err, inv.name)}
+	}
+	if named {
+		inv.args = inv.args[1:]
+	}
+	inv.opts.given = map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { inv.opts.given[f.Name] = true })
+
+	c := inv.cmd
+	switch {
+	case len(inv.args) < c.minArgs:
+		return nil, &usageError{cmd: c, err: fmt.Errorf("bkup %s needs %s", inv.name, strings.TrimPrefix(c.usage[0], c.names[0]+" "))}
+	case c.maxArgs >= 0 && len(inv.args) > c.maxArgs:
+		return nil, &usageError{cmd: c, err: fmt.Errorf("unexpected argument %q", inv.args[c.maxArgs])}
+	}
+	if inv.opts.wait && inv.opts.noWait {
+		return nil, &usageError{cmd: c, err: errors.New("--wait and --no-wait contradict each other")}
+	}
+	return inv, nil
+}
+
+// parseInterspersed parses flags anywhere in args and returns the positional
+// arguments in order. Everything after "--" is positional.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		// The flag package would read a negative number (config set
+		// max_versions -1) as a flag.
+		if len(args) > 0 && isNegativeNumber(args[0]) {
+			pos, args = append(pos, args[0]), args[1:]
+			continue
+		}
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return pos, nil
+		}
+		if len(args) > len(rest) && args[len(args)-len(rest)-1] == "--" {
+			return append(pos, rest...), nil
+		}
+		pos = append(pos, rest[0])
+		args = rest[1:]
+	}
+}
+
+func isNegativeNumber(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil && strings.HasPrefix(s, "-")
+}
+
+// flagError rewrites the flag package's errors in bkup's words and with
+// the flag spelled as in help (--jobs, not -jobs).
+func flagError(err error, cmd string) error {
+	msg := err.Error()
+	name := func(s string) string { return flagName(strings.TrimLeft(s, "-")) }
+	switch {
+	case strings.HasPrefix(msg, "flag provided but not defined: "):
+		f := name(strings.TrimPrefix(msg, "flag provided but not defined: "))
+		if cmd != "" {
+			return fmt.Errorf("bkup %s does not take %s", cmd, f)
+		}
+		return fmt.Errorf("unknown flag %s", f)
+	case strings.HasPrefix(msg, "flag needs an argument: "):
+		return fmt.Errorf("%s needs a value", name(strings.TrimPrefix(msg, "flag needs an argument: ")))
+	case strings.HasPrefix(msg, "invalid value "), strings.HasPrefix(msg, "invalid boolean value "):
+		// invalid value "0" for flag -jobs: expected a positive number
+		rest := msg[strings.Index(msg, "value ")+len("value "):]
+		val, rest, _ := strings.Cut(rest, " for flag ")
+		f, reason, _ := strings.Cut(rest, ": ")
+		return fmt.Errorf("invalid %s %s: %s", name(f), val, reason)
+	}
+	return err
+}
+
+// flagName is how a flag is written in help: -q, --jobs.
+func flagName(name string) string {
+	if len(name) == 1 {
+		return "-" + name
+	}
+	return "--" + name
+}
+
+// printCommandHelp prints the usage of c (bkup <cmd> --help).
+func printCommandHelp(w io.Writer, c *command) {
+	for i, u := range c.usage {
+		prefix := "Usage: "
+		if i > 0 {
+			prefix = "       "
+		}
+		fmt.Fprintf(w, "%sbkup %s\n", prefix, u)
+	}
+	fmt.Fprintln(w, c.help)
+	if len(c.flags) > 0 {
+		fmt.Fprintln(w, "\nFlags:")
+		printFlags(w, c.flags)
+	}
+	fmt.Fprintln(w, "\nGlobal flags:")
+	printFlags(w, globalFlags)
+}
+
+func printFlags(w io.Writer, names []string) {
+	for _, name := range names {
+		d := findFlagDef(name)
+		left := flagName(d.name)
+		if d.arg != "" {
+			left += " " + d.arg
+		}
+		fmt.Fprintf(w, "  %-20s %s\n", left, d.help)
+	}
+}
+
+func cmdHelp(e *env, args []string) error {
+	if len(args) == 0 {
+		usage()
+		return nil
+	}
+	c := findCommand(args[0])
+	if c == nil {
+		return &usageError{err: fmt.Errorf("unknown command %q", args[0])}
+	}
+	printCommandHelp(os.Stdout, c)
+	return nil
+}
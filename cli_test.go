@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	tests := []struct {
+		args    []string
+		name    string   // command as typed
+		pos     []string // positional arguments
+		opts    func(o options) bool
+		help    bool
+		wantErr string // "" = valid
+	}{
+		{args: nil, name: "backup"},
+		{args: []string{"-q", "-m", "before refactor"}, name: "backup",
+			opts: func(o options) bool { return o.queue && o.message == "before refactor" }},
+		{args: []string{"-q", "pull", "3"}, name: "pull", pos: []string{"3"},
+			opts: func(o options) bool { return o.queue }},
+		{args: []string{"pull", "3", "-q"}, name: "pull", pos: []string{"3"},
+			opts: func(o options) bool { return o.queue }},
+		{args: []string{"--root", "/mnt/usb", "list", "--grep", "-fix"}, name: "list",
+			opts: func(o options) bool { return o.root == "/mnt/usb" && o.grep == "-fix" }},
+		{args: []string{"unpin", "known-good"}, name: "unpin", pos: []string{"known-good"}},
+		{args: []string{"prune", "--keep-last", "3", "--dry-run"}, name: "prune",
+			opts: func(o options) bool { return o.keepLast == 3 && o.dryRun && o.given["keep-last"] }},
+		{args: []string{"prune", "--older-than", "2w"}, name: "prune",
+			opts: func(o options) bool { return o.keepLast == -1 && !o.given["keep-last"] }},
+
+		// Negative numbers are arguments, not flags.
+		{args: []string{"config", "set", "max_versions", "-1"}, name: "config", pos: []string{"set", "max_versions", "-1"}},
+		{args: []string{"config", "set", "x", "-2.5", "--effective"}, name: "config", pos: []string{"set", "x", "-2.5"},
+			opts: func(o options) bool { return o.effective }},
+
+		// "--" ends the flags.
+		{args: []string{"note", "2", "--", "-m", "--no-wait"}, name: "note", pos: []string{"2", "-m", "--no-wait"},
+			opts: func(o options) bool { return o.message == "" && !o.noWait }},
+		{args: []string{"--", "pull"}, wantErr: `unexpected argument "pull"`},
+
+		{args: []string{"pull", "--help"}, name: "pull", help: true},
+		{args: []string{"frobnicate"}, wantErr: `unknown command "frobnicate"`},
+		{args: []string{"note", "2", "-m", "text"}, wantErr: "bkup note does not take -m"},
+		{args: []string{"-m"}, wantErr: "-m needs a value"},
+		{args: []string{"--jobs", "0"}, wantErr: `invalid --jobs "0": expected a positive number`},
+		{args: []string{"prune", "--keep-last", "-1"}, wantErr: `invalid --keep-last "-1"`},
+		{args: []string{"tag", "3"}, wantErr: "bkup tag needs <number|tag> <name>"},
+		{args: []string{"--wait", "--no-wait"}, wantErr: "contradict"},
+	}
+	for _, tt := range tests {
+		inv, err := parseCommandLine(tt.args)
+		if tt.wantErr != "" {
+			var ue *usageError
+			if !errors.As(err, &ue) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseCommandLine(%q) = %v, want a usage error containing %q", tt.args, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCommandLine(%q): %v", tt.args, err)
+			continue
+		}
+		if inv.name != tt.name || inv.help != tt.help || len(inv.args)+len(tt.pos) > 0 && !reflect.DeepEqual(inv.args, tt.pos) {
+			t.Errorf("parseCommandLine(%q) = %s %q (help %v), want %s %q (help %v)",
+				tt.args, inv.name, inv.args, inv.help, tt.name, tt.pos, tt.help)
+		}
+		if tt.opts != nil && !tt.opts(inv.opts) {
+			t.Errorf("parseCommandLine(%q): unexpected options %+v", tt.args, inv.opts)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// env is what every command runs with.
+type env struct {
+	name       string // the command as typed (pin or unpin)
+	opts       options
+	backupRoot string
+	cfgPath    string
+	statePath  string
+	global     Config         // config.json alone
+	projectCfg *ProjectConfig // .bkup.json / .bkup.toml in src (nil = none)
+	cfg        Config         // global with projectCfg merged in: what commands use
+	cfgErr     error          // loading either config failed (only bkup config runs then)
+	cwd        string         // where bkup was started
+	src        string         // the project's source dir: --project, else cwd
+}
+
+func (e *env) backupOptions() backupOptions {
+	return backupOptions{queueMode: e.opts.queue, message: e.opts.message, jobs: e.opts.jobs, force: e.opts.force}
+}
+
+func (e *env) project() (Project, error) {
+	return resolveProject(e.backupRoot, e.src)
+}
+
+// bkup [-q] [-m message] [--force]
+func cmdBackup(e *env, args []string) error {
+	dst, err := backupNewVersion(e.src, e.backupRoot, e.cfg, e.backupOptions())
+	if err != nil {
+		return err
+	}
+	fmt.Println(dst)
+	return nil
+}
+
+// bkup config [show [--effective] | get <key> | set <key> <value> | unset <key> | list | validate]
+func cmdConfig(e *env, args []string) error {
+	sub := ""
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	argSpec := map[string]string{"": "", "show": "", "get": "<key>", "set": "<key> <value>", "unset": "<key>", "list": "", "validate": ""}
+	spec, ok := argSpec[sub]
+	n := len(strings.Fields(spec)) + 1
+	switch {
+	case !ok:
+		return &usageError{cmd: findCommand("config"), err: fmt.Errorf("unknown config subcommand %q", sub)}
+	case sub != "" && len(args) < n:
+		return &usageError{cmd: findCommand("config"), err: fmt.Errorf("bkup config %s needs %s", sub, spec)}
+	case sub != "" && len(args) > n:
+		return &usageError{cmd: findCommand("config"), err: fmt.Errorf("unexpected argument %q", args[n])}
+	case e.opts.effective && sub != "show":
+		return &usageError{cmd: findCommand("config"), err: errors.New("--effective only goes with config show")}
+	}
+
+	switch sub {
+	case "":
+		if err := ensureConfigExists(e.cfgPath, e.global); err != nil {
+			return err
+		}
+		return editConfig(e.cfgPath)
+	case "get":
+		return configGet(e.cfgPath, args[1])
+	case "set":
+		return configSet(e.cfgPath, args[1], args[2])
+	case "unset":
+		return configUnset(e.cfgPath, args[1])
+	case "list":
+		return configList(e.cfgPath)
+	case "validate":
+		return configValidate(e.cfgPath, e.src)
+	}
+
+	if e.cfgErr != nil {
+		return e.cfgErr
+	}
+	if !e.opts.effective {
+		b, err := json.MarshalIndent(e.global, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal config: %w", err)
+		}
+		fmt.Printf("# %s\n%s\n", e.cfgPath, b)
+		return nil
+	}
+
+	keys, err := configKeys(e.cfgPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# project %s\n", e.src)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, s := range effectiveSettings(e.global, keys, e.cfgPath, e.projectCfg, e.src) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.key, s.source, s.value)
+	}
+	return tw.Flush()
+}
+
+// bkup go [number|tag] [--print]
+//
+// Per your spec: go does NOT create a new backup (except first-run where none exist).
+// It jumps to the newest existing backup, determined by .bkup_meta.json timestamps,
+// or to the one named by number or tag.
+func cmdGo(e *env, args []string) error {
+	proj, err := e.project()
+	if err != nil {
+		return err
+	}
+	project, projectRoot := proj.Name, proj.Root
+
+	var latest Version
+	ok := false
+	if len(args) >= 1 {
+		if latest, err = resolveVersionRef(projectRoot, project, args[0]); err != nil {
+			return err
+		}
+		ok = true
+	} else if latest, ok, err = newestVersion(projectRoot, project); err != nil {
+		return err
+	}
+	if !ok {
+		if _, err := backupNewVersion(e.src, e.backupRoot, e.cfg, e.backupOptions()); err != nil {
+			return err
+		}
+		if latest, _, err = newestVersion(projectRoot, project); err != nil {
+			return err
+		}
+	}
+	warnForeignVersion(proj, latest)
+
+	// Save previous location for revert.
+	st, err := loadState(e.statePath)
+	if err != nil {
+		return err
+	}
+	st.PrevPath = e.cwd
+	if err := saveStateAtomic(e.statePath, st); err != nil {
+		return err
+	}
+
+	// Non-dir formats (chunked) are rebuilt into a plain tree first:
+	// a persistent checkout for --print, a temp dir for the subshell.
+	if e.opts.print {
+		dir, err := checkoutVersion(e.backupRoot, e.cfg, latest)
+		if err != nil {
+			return err
+		}
+		fmt.Println(dir)
+		return nil
+	}
+	dir, cleanup, err := materializeVersion(e.backupRoot, e.cfg, latest)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return openSubshell(dir)
+}
+
+// bkup revert [--print]
+func cmdRevert(e *env, args []string) error {
+	st, err := loadState(e.statePath)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(st.PrevPath) == "" {
+		return fmt.Errorf("prev_path is empty in %s (run `bkup go` first)", e.statePath)
+	}
+
+	if e.opts.print {
+		fmt.Println(st.PrevPath)
+		return nil
+	}
+	return openSubshell(st.PrevPath)
+}
+
+// bkup list [--grep pattern]
+func cmdList(e *env, args []string) error {
+	proj, err := e.project()
+	if err != nil {
+		return err
+	}
+	vers, err := listProjectVersions(proj.Root, proj.Name)
+	if err != nil {
+		return err
+	}
+	if len(vers) == 0 {
+		fmt.Println("(no backups found)")
+		return nil
+	}
+	var grep *regexp.Regexp
+	if e.opts.grep != "" {
+		if grep, err = regexp.Compile("(?i)" + e.opts.grep); err != nil {
+			return fmt.Errorf("invalid --grep pattern: %w", err)
+		}
+	}
+	sort.Slice(vers, func(i, j int) bool { return vers[i].N < vers[j].N })
+	for _, v := range vers {
+		if grep != nil && !grep.MatchString(v.Message) {
+			continue
+		}
+		warnForeignVersion(proj, v)
+		fmt.Println(formatVersionLine(v))
+	}
+	return nil
+}
+
+// bkup pull [number|tag] [-q]
+func cmdPull(e *env, args []string) error {
+	proj, err := e.project()
+	if err != nil {
+		return err
+	}
+	project, projectRoot := proj.Name, proj.Root
+	lock, err := lockProject(e.backupRoot, proj)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	var pullVer Version
+	if len(args) == 0 {
+		ok := false
+		if pullVer, ok, err = newestVersion(projectRoot, project); err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("no backups found to pull")
+		}
+	} else {
+		// Ensure requested backup exists BEFORE doing anything else.
+		if pullVer, err = resolveVersionRef(projectRoot, project, args[0]); err != nil {
+			return err
+		}
+		if pullVer.partial() {
+			return fmt.Errorf("%s only holds %s; pulling it would delete everything else (use `bkup restore %s <path>...`)",
+				pullVer.Path, strings.Join(pullVer.Paths, ", "), args[0])
+		}
+	}
+	pullSrc := pullVer.Path
+	warnForeignVersion(proj, pullVer)
+
+	// Create safety backup first (hard-cap may refuse; -q may overwrite oldest
+	// excluding the backup we're pulling FROM).
+	opts := e.backupOptions()
+	opts.protectedNums = map[int]bool{pullVer.N: true}
+	opts.message = fmt.Sprintf("safety backup before pulling %s", filepath.Base(pullSrc))
+	safetyDst, err := backupNewVersion(e.src, e.backupRoot, e.cfg, opts)
+	if err != nil {
+		return fmt.Errorf("refusing to pull because a safety backup cannot be created first: %w", err)
+	}
+
+	// Replace current directory contents with the pulled backup,
+	// leaving ignored paths in the working directory untouched.
+	ign, err := loadIgnoreMatcher(e.src, e.backupRoot, e.cfg)
+	if err != nil {
+		return err
+	}
+	treeDir, cleanup, err := materializeVersion(e.backupRoot, e.cfg, pullVer)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	// A Ctrl-C during the swap is reported once it is done, with the
+	// outcome: a completed pull is still announced.
+	err = replaceDirContents(e.src, treeDir, ign, copyWorkers(e.cfg, e.opts.jobs))
+	var ie *interruptedError
+	if err != nil && (!errors.As(err, &ie) || ie.err != nil) {
+		return err
+	}
+
+	fmt.Printf("Pulled %s into %s\n", pullSrc, e.src)
+	fmt.Printf("Safety backup created: %s\n", safetyDst)
+	return err
+}
+
+// bkup note <number|tag> [text...]   (no text clears the message)
+func cmdNote(e *env, args []string) error {
+	proj, err := e.project()
+	if err != nil {
+		return err
+	}
+	v, err := resolveVersionRef(proj.Root, proj.Name, args[0])
+	if err != nil {
+		return err
+	}
+	text := strings.TrimSpace(strings.Join(args[1:], " "))
+	if err := updateMeta(v.Path, func(m *Meta) { m.Message = text }); err != nil {
+		return err
+	}
+	v.Message = text
+	fmt.Println(formatVersionLine(v))
+	return nil
+}
+
+// bkup pin <number|tag>  /  bkup unpin <number|tag>
+func cmdPin(e *env, args []string) error {
+	proj, err := e.project()
+	if err != nil {
+		return err
+	}
+	v, err := resolveVersionRef(proj.Root, proj.Name, args[0])
+	if err != nil {
+		return err
+	}
+	pinned := e.name == "pin"
+	if err := pinVersion(proj.Root, proj.Name, e.cfg, v, pinned); err != nil {
+		return err
+	}
+	v.Pinned = pinned
+	fmt.Println(formatVersionLine(v))
+	return nil
+}
+
+// bkup tag <number|tag> <name>
+func cmdTag(e *env, args []string) error {
+	proj, err := e.project()
+	if err != nil {
+		return err
+	}
+	v, err := resolveVersionRef(proj.Root, proj.Name, args[0])
+	if err != nil {
+		return err
+	}
+	if err := tagVersion(proj.Root, proj.Name, e.cfg, v, args[1]); err != nil {
+		return err
+	}
+	if v, err = findVersion(proj.Root, proj.Name, v.N); err != nil {
+		return err
+	}
+	fmt.Println(formatVersionLine(v))
+	return nil
+}
+
+// bkup untag <name>
+func cmdUntag(e *env, args []string) error {
+	proj, err := e.project()
+	if err != nil {
+		return err
+	}
+	v, err := untagVersion(proj.Root, proj.Name, args[0])
+	if err != nil {
+		return err
+	}
+	if v, err = findVersion(proj.Root, proj.Name, v.N); err != nil {
+		return err
+	}
+	fmt.Println(formatVersionLine(v))
+	return nil
+}
+
+// bkup restore <number|tag> <path>... [-q]
+func cmdRestore(e *env, args []string) error {
+	return runRestore(os.Stdout, e.backupRoot, e.cfg, e.src, args[0], args[1:], e.opts.queue, e.opts.jobs)
+}
+
+// bkup clean (single project)
+func cmdClean(e *env, args []string) error {
+	proj, err := e.project()
+	if err != nil {
+		return err
+	}
+	lock, err := lockProject(e.backupRoot, proj)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	if err := os.RemoveAll(proj.Root); err != nil {
+		return fmt.Errorf("remove project backups: %w", err)
+	}
+	if err := removeRemoteDir(e.backupRoot, proj.Root); err != nil {
+		return fmt.Errorf("remove remote project backups: %w", err)
+	}
+	fmt.Println("Removed:", proj.Root)
+	return nil
+}
+
+// bkup cleanse (entire backup root except config, state, keyring and locks)
+func cmdCleanse(e *env, args []string) error {
+	removed, err := cleanseBackupRoot(e.backupRoot, e.cfgPath, e.statePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Cleansed %d item(s) in %s. Kept the keyring and %s.\n", removed, e.backupRoot, e.cfgPath)
+	return nil
+}
+
+// bkup diff [a] [b] [--patch]
+func cmdDiff(e *env, args []string) error {
+	return runDiff(os.Stdout, e.backupRoot, e.cfg, e.src, args, e.opts.patch)
+}
+
+// bkup verify [number|tag|--all]
+func cmdVerify(e *env, args []string) error {
+	proj, err := e.project()
+	if err != nil {
+		return err
+	}
+	project, projectRoot := proj.Name, proj.Root
+
+	var targets []Version
+	switch {
+	case e.opts.all:
+		if targets, err = listProjectVersions(projectRoot, project); err != nil {
+			return err
+		}
+	case len(args) >= 1:
+		v, err := resolveVersionRef(projectRoot, project, args[0])
+		if err != nil {
+			return err
+		}
+		targets = []Version{v}
+	default:
+		v, ok, err := newestVersion(projectRoot, project)
+		if err != nil {
+			return err
+		}
+		if ok {
+			targets = []Version{v}
+		}
+	}
+	if len(targets) == 0 {
+		return errors.New("no backups found to verify")
+	}
+
+	failed := false
+	for _, v := range targets {
+		res, err := verifyVersion(e.backupRoot, e.cfg, v)
+		if err != nil {
+			return err
+		}
+		printVerifyResult(os.Stdout, res)
+		if !res.ok() {
+			failed = true
+		}
+	}
+	if failed {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// bkup watch [-q] [-m message]
+func cmdWatch(e *env, args []string) error {
+	return runWatch(os.Stdout, e.backupRoot, e.cfg, e.src, e.backupOptions())
+}
+
+// bkup prune [--older-than age] [--keep-last n] [--max-size size] [--dry-run]
+func cmdPrune(e *env, args []string) error {
+	opts := pruneOptions{
+		olderThan: e.opts.olderThan,
+		keepLast:  e.opts.keepLast,
+		maxSize:   e.opts.maxSize,
+		dryRun:    e.opts.dryRun,
+	}
+	return runPrune(os.Stdout, e.backupRoot, e.src, opts)
+}
+
+// bkup rekey (new passphrase from $BKUP_NEW_PASSPHRASE or a prompt)
+func cmdRekey(e *env, args []string) error {
+	lock, err := lockRoot(e.backupRoot)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	if err := rekey(e.backupRoot, e.cfg.Encryption); err != nil {
+		return err
+	}
+	fmt.Println("Passphrase changed:", keyringPath(e.backupRoot))
+	return nil
+}
+
+// bkup gc (drop chunk objects no manifest references anymore)
+func cmdGC(e *env, args []string) error {
+	release, err := lockEverything(e.backupRoot)
+	if err != nil {
+		return err
+	}
+	defer release()
+	removed, freed, err := gcObjects(e.backupRoot)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d unreferenced object(s), freed %d byte(s).\n", removed, freed)
+	if remote := remoteFor(e.backupRoot); remote != nil {
+		removed, freed, err := gcBackendObjects(remote)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d unreferenced object(s) from %s, freed %d byte(s).\n", removed, remote, freed)
+	}
+	return nil
+}
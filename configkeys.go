@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -------------------- CONFIG KEYS --------------------
+//
+// bkup config get/set/unset/list/validate work on config.json without an
+// editor (scripts, dotfile bootstrap, CI). Keys are dotted paths into the
+// Config schema: max_versions, retention.keep_daily, stores.external,
+// stores.cloud.backend.bucket. set parses the value as the key's type:
+// numbers, true/false and strings as typed, lists as JSON or comma-separated,
+// objects as JSON. Every change is checked like `bkup config validate` before
+// saveConfigAtomic writes it, so a bad value never reaches the file.
+//
+// The editor (plain `bkup config`) works on a copy that is checked the same
+// way when the editor exits, and only then saved over config.json, also with
+// saveConfigAtomic.
+
+// configTree is config.json as generic JSON, numbers kept as written.
+type configTree = map[string]any
+
+// schemaType returns the type of the setting at key, or an error naming the
+// keys that exist at the point where key went wrong.
+func schemaType(key string) (reflect.Type, error) {
+	t := reflect.TypeFor[Config]()
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		t = derefType(t)
+		at := strings.Join(parts[:i], ".")
+		if part == "" {
+			return nil, fmt.Errorf("invalid key %q", key)
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			f, ok := jsonField(t, part)
+			if !ok {
+				where := "config.json"
+				if at != "" {
+					where = at
+				}
+				return nil, fmt.Errorf("unknown key %q (%s has: %s)", key, where, strings.Join(jsonFieldNames(t), ", "))
+			}
+			t = f.Type
+		case reflect.Map:
+			t = t.Elem()
+		default:
+			return nil, fmt.Errorf("unknown key %q: %s is not an object", key, at)
+		}
+	}
+	return derefType(t), nil
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if k, _, _ := strings.Cut(f.Tag.Get("json"), ","); k == name && f.IsExported() {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		if k, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); k != "" && k != "-" && t.Field(i).IsExported() {
+			names = append(names, k)
+		}
+	}
+	return names
+}
+
+// parseConfigValue turns the command-line value raw into JSON for key, whose
+// schema type is t, and checks that it decodes as t.
+func parseConfigValue(key string, t reflect.Type, raw string) (any, error) {
+	var v any
+	switch t.Kind() {
+	case reflect.String:
+		v = raw
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s takes true or false, not %q", key, raw)
+		}
+		v = b
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s takes a whole number, not %q", key, raw)
+		}
+		v = json.Number(strconv.FormatInt(n, 10))
+	default:
+		dec := json.NewDecoder(strings.NewReader(raw))
+		dec.UseNumber()
+		err := dec.Decode(&v)
+		switch {
+		case err == nil:
+		case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+			list := []any{}
+			for _, s := range strings.Split(raw, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+			v = list
+		case reflect.PointerTo(t).Implements(reflect.TypeFor[json.Unmarshaler]()):
+			v = raw // e.g. a store given as a plain path
+		default:
+			return nil, fmt.Errorf("%s takes a JSON %s: %w", key, jsonKind(t), err)
+		}
+	}
+
+	b, _ := json.Marshal(v)
+	if err := json.Unmarshal(b, reflect.New(t).Interface()); err != nil {
+		return nil, fmt.Errorf("%s takes a %s, not %s", key, jsonKind(t), raw)
+	}
+	return v, nil
+}
+
+// jsonKind names t the way JSON would.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Slice:
+		return "list"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	}
+	return "number"
+}
+
+// readConfigTree reads cfgPath as a configTree; a missing file is empty.
+func readConfigTree(cfgPath string) (configTree, error) {
+	b, err := os.ReadFile(cfgPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return configTree{}, nil
+		}
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	tree := configTree{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&tree); err != nil {
+		return nil, fmt.Errorf("parse %s: %w (fix it with `bkup config`)", cfgPath, err)
+	}
+	return tree, nil
+}
+
+// writeConfigTree checks tree like `bkup config validate` and saves it.
+func writeConfigTree(cfgPath string, tree configTree) error {
+	b, err := json.Marshal(tree)
+	if err != nil {
+		return fmt.Errorf("marshal config: %w", err)
+	}
+	cfg, err := parseConfig(cfgPath, b, true)
+	if err != nil {
+		return err
+	}
+	return saveConfigAtomic(cfgPath, cfg)
+}
+
+// lookupKey returns the value at the dotted key in tree.
+func lookupKey(tree configTree, key string) (any, bool) {
+	var cur any = tree
+	for _, part := range strings.Split(key, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			if s, isStr := cur.(string); isStr && part == "path" {
+				return s, true // a store written as a plain path
+			}
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// setKey stores v at the dotted key in tree, creating objects on the way.
+func setKey(tree configTree, key string, v any) {
+	parts := strings.Split(key, ".")
+	m := tree
+	for _, part := range parts[:len(parts)-1] {
+		switch next := m[part].(type) {
+		case map[string]any:
+			m = next
+		case string:
+			// A store written as a plain path becomes {"path": ...}.
+			obj := map[string]any{"path": next}
+			m[part], m = obj, obj
+		default:
+			obj := map[string]any{}
+			m[part], m = obj, obj
+		}
+	}
+	m[parts[len(parts)-1]] = v
+}
+
+// unsetKey removes the dotted key from tree, and objects it leaves empty.
+func unsetKey(tree configTree, key string) bool {
+	parts := strings.Split(key, ".")
+	m := tree
+	path := []map[string]any{tree}
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := m[part].(map[string]any)
+		if !ok {
+			return false
+		}
+		m = next
+		path = append(path, m)
+	}
+	if _, ok := m[parts[len(parts)-1]]; !ok {
+		return false
+	}
+	delete(m, parts[len(parts)-1])
+	for i := len(path) - 1; i > 0 && len(path[i]) == 0; i-- {
+		delete(path[i-1], parts[i-1])
+	}
+	return true
+}
+
+// formatConfigValue prints strings as they are and everything else as JSON.
+func formatConfigValue(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// flattenConfig lists tree as key=value lines, one per setting.
+func flattenConfig(prefix string, v any, out *[]string) {
+	m, ok := v.(map[string]any)
+	if !ok || (len(m) == 0 && prefix != "") {
+		*out = append(*out, prefix+"="+formatConfigValue(v))
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		flattenConfig(key, m[k], out)
+	}
+}
+
+// -------------------- CONFIG SUBCOMMANDS --------------------
+
+func configGet(cfgPath, key string) error {
+	if _, err := schemaType(key); err != nil {
+		return err
+	}
+	tree, err := readConfigTree(cfgPath)
+	if err != nil {
+		return err
+	}
+	v, ok := lookupKey(tree, key)
+	if !ok {
+		return fmt.Errorf("%s is not set in %s", key, cfgPath)
+	}
+	fmt.Println(formatConfigValue(v))
+	return nil
+}
+
+func configSet(cfgPath, key, raw string) error {
+	t, err := schemaType(key)
+	if err != nil {
+		return err
+	}
+	v, err := parseConfigValue(key, t, raw)
+	if err != nil {
+		return err
+	}
+	tree, err := readConfigTree(cfgPath)
+	if err != nil {
+		return err
+	}
+	setKey(tree, key, v)
+	return writeConfigTree(cfgPath, tree)
+}
+
+func configUnset(cfgPath, key string) error {
+	tree, err := readConfigTree(cfgPath)
+	if err != nil {
+		return err
+	}
+	// Unknown keys can be removed too: that is how a typo gets fixed.
+	if !unsetKey(tree, key) {
+		if _, err := schemaType(key); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s is not set in %s", key, cfgPath)
+	}
+	return writeConfigTree(cfgPath, tree)
+}
+
+func configList(cfgPath string) error {
+	tree, err := readConfigTree(cfgPath)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	flattenConfig("", tree, &lines)
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+	return nil
+}
+
+// configValidate checks config.json and the project config in src.
+func configValidate(cfgPath, src string) error {
+	b, err := os.ReadFile(cfgPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read config: %w", err)
+	}
+	if err == nil {
+		if _, err := parseConfig(cfgPath, b, true); err != nil {
+			return err
+		}
+		fmt.Println("ok:", cfgPath)
+	}
+	pc, err := loadProjectConfig(src)
+	if err != nil {
+		return err
+	}
+	if pc != nil {
+		fmt.Println("ok:", pc.path)
+	}
+	return nil
+}
+
+// editConfig opens a copy of cfgPath in the editor and, once the editor
+// exits, saves it with saveConfigAtomic if it passes `bkup config validate`.
+// Otherwise it shows the error and offers to edit again; declining leaves
+// cfgPath as it was.
+func editConfig(cfgPath string) error {
+	orig, err := os.ReadFile(cfgPath)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(cfgPath), "config.*.json")
+	if err != nil {
+		return fmt.Errorf("create temp config: %w", err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	_, err = f.Write(orig)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write temp config: %w", err)
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	for {
+		if err := openEditor(tmp); err != nil {
+			return err
+		}
+		b, err := os.ReadFile(tmp)
+		if err != nil {
+			return fmt.Errorf("read edited config: %w", err)
+		}
+		cfg, perr := parseConfig(cfgPath, b, true)
+		switch {
+		case perr == nil && bytes.Equal(b, orig):
+			return nil
+		case perr == nil:
+			return saveConfigAtomic(cfgPath, cfg)
+		}
+		fmt.Fprintln(os.Stderr, "bkup error:", perr)
+		fmt.Fprint(os.Stderr, "Edit again? (n keeps the old config.json and drops your changes) [Y/n] ")
+		answer, rerr := in.ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a == "n" || a == "no" || (rerr != nil && a == "") {
+			return errors.New("config.json left unchanged")
+		}
+	}
+}
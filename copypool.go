@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// -------------------- PARALLEL COPY --------------------
+//
+// copyDirContents walks the source on one goroutine: it creates directories
+// and symlinks itself and queues regular files on a bounded channel for a pool
+// of copy workers. The first error wins: it is what copyDirContents returns,
+// the walk stops, and workers stop taking new files (copies already running
+// finish first, so nothing writes into the destination after we return).
+
+const defaultCopyWorkers = 8
+
+// copyWorkers returns the number of parallel file copies: --jobs, else
+// copy_workers from config.json, else defaultCopyWorkers.
+func copyWorkers(cfg Config, jobs int) int {
+	switch {
+	case jobs > 0:
+		return jobs
+	case cfg.CopyWorkers > 0:
+		return cfg.CopyWorkers
+	}
+	return defaultCopyWorkers
+}
+
+type copyJob struct {
+	src, dst, rel string
+	info          fs.FileInfo
+	entry         *ManifestEntry // filled in by the worker (SHA256)
+}
+
+type copyPool struct {
+	opts copyOptions
+	jobs chan copyJob
+	wg   sync.WaitGroup
+
+	mu   sync.Mutex
+	err  error
+	stop chan struct{} // closed on the first error
+}
+
+func newCopyPool(workers int, opts copyOptions) *copyPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &copyPool{
+		opts: opts,
+		jobs: make(chan copyJob, workers*4),
+		stop: make(chan struct{}),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *copyPool) work() {
+	defer p.wg.Done()
+	for j := range p.jobs {
+		if p.failed() != nil {
+			continue // drain without copying
+		}
+		if err := copyRegularFile(j, p.opts); err != nil {
+			p.fail(err)
+		}
+	}
+}
+
+// submit queues j, or returns the first error if the pool has already failed.
+func (p *copyPool) submit(j copyJob) error {
+	select {
+	case p.jobs <- j:
+		return nil
+	case <-p.stop:
+		return p.failed()
+	}
+}
+
+func (p *copyPool) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+		close(p.stop)
+	}
+}
+
+func (p *copyPool) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// wait closes the queue, waits for every worker to finish and returns the first error.
+func (p *copyPool) wait() error {
+	close(p.jobs)
+	p.wg.Wait()
+	return p.failed()
+}
+
+// copyRegularFile hard-links j.src's counterpart in opts.linkDest if unchanged,
+// else copies the bytes, hashing them when a manifest is being recorded.
+func copyRegularFile(j copyJob, opts copyOptions) error {
+	if opts.linkDest != "" && linkUnchanged(filepath.Join(opts.linkDest, j.rel), j.dst, j.info) {
+		if opts.record != nil {
+			sum, ok := opts.linkHashes[j.entry.Path]
+			if !ok {
+				var err error
+				if sum, err = sha256File(j.dst); err != nil {
+					return err
+				}
+			}
+			j.entry.SHA256 = sum
+		}
+		return nil
+	}
+	var h hash.Hash
+	if opts.record != nil {
+		h = sha256.New()
+	}
+	if err := copyFile(j.src, j.dst, j.info.Mode(), h); err != nil {
+		return err
+	}
+	_ = os.Chtimes(j.dst, time.Now(), j.info.ModTime())
+	if h != nil {
+		j.entry.SHA256 = hexSum(h)
+	}
+	return nil
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// -------------------- ENCRYPTION AT REST --------------------
+//
+// With "encryption": {"enabled": true}, new versions are sealed with AES-256-GCM:
+//   - archives (tar.gz / tar.zst; "dir" becomes tar.zst) are written as a sealed
+//     stream, so file names and contents are both hidden
+//   - chunked versions seal every object and name it by an HMAC of its plaintext
+//     (plain SHA-256 ids would let anyone confirm a guessed file)
+//   - the manifest is sealed too; .bkup_meta.json (time, source path, message,
+//     pins, tags) stays readable so list/prune/pin work without the passphrase
+//
+// The data key is random and stored in <backupRoot>/keyring.json, wrapped by a
+// key derived from the passphrase with scrypt. `bkup rekey` only rewraps it, so
+// changing the passphrase never re-encrypts backups.
+
+const (
+	keyringFileName      = "keyring.json"
+	objectListFileName   = ".bkup_objects" // object ids of a sealed chunked version, for gc
+	defaultPassphraseEnv = "BKUP_PASSPHRASE"
+	newPassphraseEnv     = "BKUP_NEW_PASSPHRASE"
+
+	blobMagic   = "bkupenc1"
+	streamMagic = "bkupstr1"
+	segmentSize = 64 << 10
+)
+
+var errSealed = errors.New("backup is encrypted and no key was given")
+
+// EncryptionConfig is the "encryption" block of config.json.
+type EncryptionConfig struct {
+	Enabled       bool   `json:"enabled"`
+	PassphraseEnv string `json:"passphrase_env,omitempty"` // default BKUP_PASSPHRASE
+	Keyfile       string `json:"keyfile,omitempty"`        // file holding the passphrase
+}
+
+func (c *EncryptionConfig) enabled() bool { return c != nil && c.Enabled }
+
+// sealKey encrypts and authenticates stored data.
+type sealKey struct {
+	aead  cipher.AEAD
+	idKey []byte
+}
+
+func newSealKey(dataKey []byte) (*sealKey, error) {
+	encKey, err := hkdf.Key(sha256.New, dataKey, nil, "bkup content", 32)
+	if err != nil {
+		return nil, err
+	}
+	idKey, err := hkdf.Key(sha256.New, dataKey, nil, "bkup object id", 32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sealKey{aead: aead, idKey: idKey}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// objectID names a chunk: SHA-256 of the plaintext, or its HMAC when sealed.
+func (k *sealKey) objectID(data []byte) string {
+	if k == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, k.idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sealBlob encrypts a small, self-contained value (a chunk or a manifest).
+func (k *sealKey) sealBlob(plain []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	out := append([]byte(blobMagic), nonce...)
+	return k.aead.Seal(out, nonce, plain, []byte(blobMagic))
+}
+
+func (k *sealKey) openBlob(b []byte) ([]byte, error) {
+	ns := k.aead.NonceSize()
+	if !isSealedBlob(b) || len(b) < len(blobMagic)+ns {
+		return nil, errors.New("not an encrypted blob")
+	}
+	nonce := b[len(blobMagic) : len(blobMagic)+ns]
+	plain, err := k.aead.Open(nil, nonce, b[len(blobMagic)+ns:], []byte(blobMagic))
+	if err != nil {
+		return nil, errors.New("decryption failed (corrupted data or a different key)")
+	}
+	return plain, nil
+}
+
+func isSealedBlob(b []byte) bool { return bytes.HasPrefix(b, []byte(blobMagic)) }
+
+// -------------------- SEALED STREAMS --------------------
+//
+// Archives are sealed in 64 KiB segments. Each segment is a flag byte (1 for
+// the last one) followed by its ciphertext; the nonce is a random per-stream
+// prefix plus the segment counter, and the flag is authenticated, so segments
+// cannot be reordered, dropped or the stream truncated without detection.
+
+type sealWriter struct {
+	w      io.Writer
+	k      *sealKey
+	prefix []byte
+	ctr    uint32
+	buf    []byte
+}
+
+func newSealWriter(w io.Writer, k *sealKey) (io.WriteCloser, error) {
+	prefix := make([]byte, k.aead.NonceSize()-4)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(streamMagic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, k: k, prefix: prefix, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// A full buffer is only flushed once more data arrives, so the last
+		// segment is always the one Close writes.
+		if len(s.buf) == segmentSize {
+			if err := s.flush(0); err != nil {
+				return n, err
+			}
+		}
+		c := copy(s.buf[len(s.buf):segmentSize], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (s *sealWriter) Close() error { return s.flush(1) }
+
+func (s *sealWriter) flush(final byte) error {
+	nonce := streamNonce(s.prefix, s.ctr)
+	s.ctr++
+	out := s.k.aead.Seal([]byte{final}, nonce, s.buf, []byte{final})
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(out)
+	return err
+}
+
+type sealReader struct {
+	r      io.Reader
+	k      *sealKey
+	prefix []byte
+	ctr    uint32
+	plain  []byte
+	done   bool
+}
+
+func newSealReader(r io.Reader, k *sealKey) (io.Reader, error) {
+	hdr := make([]byte, len(streamMagic)+k.aead.NonceSize()-4)
+	if _, err := io.ReadFull(r, hdr); err != nil || !bytes.HasPrefix(hdr, []byte(streamMagic)) {
+		return nil, errors.New("not an encrypted stream")
+	}
+	return &sealReader{r: r, k: k, prefix: hdr[len(streamMagic):]}, nil
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *sealReader) next() error {
+	overhead := s.k.aead.Overhead()
+	seg := make([]byte, 1+segmentSize+overhead)
+	n, err := io.ReadFull(s.r, seg)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		seg = seg[:n]
+	case err != nil:
+		return err
+	}
+	if len(seg) < 1+overhead {
+		return errors.New("encrypted stream is truncated")
+	}
+	final := seg[0]
+	plain, err := s.k.aead.Open(nil, streamNonce(s.prefix, s.ctr), seg[1:], seg[:1])
+	if err != nil {
+		return errors.New("decryption failed (corrupted data or a different key)")
+	}
+	s.ctr++
+	if final == 1 {
+		// A short read must be the last segment; a full one may be too.
+		s.done = true
+		if len(seg) == cap(seg) {
+			if extra, _ := s.r.Read(make([]byte, 1)); extra > 0 {
+				return errors.New("encrypted stream has trailing data")
+			}
+		}
+	} else if len(seg) < cap(seg) {
+		return errors.New("encrypted stream is truncated")
+	}
+	s.plain = plain
+	return nil
+}
+
+func streamNonce(prefix []byte, ctr uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte(nil), prefix...), ctr)
+}
+
+// -------------------- KEYRING --------------------
+
+type keyringFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	ScryptN    int    `json:"scrypt_n"`
+	ScryptR    int    `json:"scrypt_r"`
+	ScryptP    int    `json:"scrypt_p"`
+	Salt       []byte `json:"salt"`
+	WrappedKey []byte `json:"wrapped_key"` // nonce || AES-GCM(data key)
+}
+
+// unlocked caches data keys per backup root so a command asks for the passphrase once.
+var unlocked = map[string]*sealKey{}
+
+func keyringPath(backupRoot string) string {
+	return filepath.Join(backupRoot, keyringFileName)
+}
+
+// unlockKey returns the data key for backupRoot. With create, a missing
+// keyring is initialized with a new passphrase.
+func unlockKey(backupRoot string, ec *EncryptionConfig, create bool) (*sealKey, error) {
+	if k := unlocked[backupRoot]; k != nil {
+		return k, nil
+	}
+	path := keyringPath(backupRoot)
+	if err := fetchFile(backupRoot, path); err != nil {
+		return nil, fmt.Errorf("fetch keyring: %w", err)
+	}
+	kr, err := readKeyring(path)
+	if os.IsNotExist(err) && create {
+		pass, err := getPassphrase(ec, "New backup passphrase: ", true)
+		if err != nil {
+			return nil, err
+		}
+		dataKey := make([]byte, 32)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+		if err := writeKeyring(path, dataKey, pass); err != nil {
+			return nil, err
+		}
+		if err := pushFile(backupRoot, path); err != nil {
+			return nil, fmt.Errorf("upload keyring: %w", err)
+		}
+		return cacheKey(backupRoot, dataKey)
+	}
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("encrypted backup but %s is missing", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pass, err := getPassphrase(ec, "Backup passphrase: ", false)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := unwrapKey(kr, pass)
+	if err != nil {
+		return nil, err
+	}
+	return cacheKey(backupRoot, dataKey)
+}
+
+func cacheKey(backupRoot string, dataKey []byte) (*sealKey, error) {
+	k, err := newSealKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	unlocked[backupRoot] = k
+	return k, nil
+}
+
+// versionKey returns the key needed to read v, or nil for plaintext versions.
+func versionKey(backupRoot string, cfg Config, v Version) (*sealKey, error) {
+	if !v.Encrypted {
+		return nil, nil
+	}
+	return unlockKey(backupRoot, cfg.Encryption, false)
+}
+
+// rekey rewraps the data key under a new passphrase.
+func rekey(backupRoot string, ec *EncryptionConfig) error {
+	path := keyringPath(backupRoot)
+	if err := fetchFile(backupRoot, path); err != nil {
+		return fmt.Errorf("fetch keyring: %w", err)
+	}
+	kr, err := readKeyring(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s does not exist (no encrypted backups yet)", path)
+		}
+		return err
+	}
+	old, err := getPassphrase(ec, "Current passphrase: ", false)
+	if err != nil {
+		return err
+	}
+	dataKey, err := unwrapKey(kr, old)
+	if err != nil {
+		return err
+	}
+	pass := []byte(os.Getenv(newPassphraseEnv))
+	if len(pass) == 0 {
+		if pass, err = promptPassphrase("New passphrase: ", true); err != nil {
+			return fmt.Errorf("%w (or set %s)", err, newPassphraseEnv)
+		}
+	}
+	if err := writeKeyring(path, dataKey, pass); err != nil {
+		return err
+	}
+	return pushFile(backupRoot, path)
+}
+
+func readKeyring(path string) (keyringFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return keyringFile{}, err
+	}
+	var kr keyringFile
+	if err := json.Unmarshal(b, &kr); err != nil {
+		return keyringFile{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if kr.Version != 1 || kr.KDF != "scrypt" {
+		return keyringFile{}, fmt.Errorf("%s: unsupported keyring (version %d, kdf %q)", path, kr.Version, kr.KDF)
+	}
+	return kr, nil
+}
+
+func writeKeyring(path string, dataKey, pass []byte) error {
+	kr := keyringFile{Version: 1, KDF: "scrypt", ScryptN: 1 << 15, ScryptR: 8, ScryptP: 1, Salt: make([]byte, 16)}
+	if _, err := rand.Read(kr.Salt); err != nil {
+		return err
+	}
+	kek, err := scrypt.Key(pass, kr.Salt, kr.ScryptN, kr.ScryptR, kr.ScryptP, 32)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	kr.WrappedKey = aead.Seal(nonce, nonce, dataKey, []byte(keyringFileName))
+
+	b, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal keyring: %w", err)
+	}
+	b = append(b, '\n')
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("write keyring temp: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func unwrapKey(kr keyringFile, pass []byte) ([]byte, error) {
+	kek, err := scrypt.Key(pass, kr.Salt, kr.ScryptN, kr.ScryptR, kr.ScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	ns := aead.NonceSize()
+	if len(kr.WrappedKey) < ns {
+		return nil, errors.New("keyring is corrupted")
+	}
+	dataKey, err := aead.Open(nil, kr.WrappedKey[:ns], kr.WrappedKey[ns:], []byte(keyringFileName))
+	if err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+	return dataKey, nil
+}
+
+// -------------------- PASSPHRASE --------------------
+
+// getPassphrase reads the passphrase from the configured env var, then the
+// keyfile, then the terminal.
+func getPassphrase(ec *EncryptionConfig, prompt string, confirm bool) ([]byte, error) {
+	env, keyfile := defaultPassphraseEnv, ""
+	if ec != nil {
+		if ec.PassphraseEnv != "" {
+			env = ec.PassphraseEnv
+		}
+		keyfile = ec.Keyfile
+	}
+	if p := os.Getenv(env); p != "" {
+		return []byte(p), nil
+	}
+	if keyfile != "" {
+		if strings.HasPrefix(keyfile, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				keyfile = filepath.Join(home, keyfile[2:])
+			}
+		}
+		b, err := os.ReadFile(keyfile)
+		if err != nil {
+			return nil, fmt.Errorf("read keyfile: %w", err)
+		}
+		b = bytes.TrimRight(b, "\r\n")
+		if len(b) == 0 {
+			return nil, fmt.Errorf("keyfile %s is empty", keyfile)
+		}
+		return b, nil
+	}
+	p, err := promptPassphrase(prompt, confirm)
+	if err != nil {
+		return nil, fmt.Errorf("%w (or set %s, or encryption.keyfile in config.json)", err, env)
+	}
+	return p, nil
+}
+
+func promptPassphrase(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("a passphrase is needed but stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("read passphrase: %w", err)
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase: %w", err)
+		}
+		if !bytes.Equal(p, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return p, nil
+}
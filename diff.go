@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// -------------------- DIFF COMMAND --------------------
+
+// runDiff implements `bkup diff [a] [b]`: with no refs it compares the newest
+// backup to cwdAbs, with one ref that backup to cwdAbs, with two refs backup a to b.
+func runDiff(w io.Writer, backupRoot string, cfg Config, cwdAbs string, refs []string, patch bool) error {
+	proj, err := resolveProject(backupRoot, cwdAbs)
+	if err != nil {
+		return err
+	}
+	project, projectRoot := proj.Name, proj.Root
+
+	ign, err := loadIgnoreMatcher(cwdAbs, backupRoot, cfg)
+	if err != nil {
+		return err
+	}
+
+	var oldV Version
+	if len(refs) == 0 {
+		v, ok, err := newestVersion(projectRoot, project)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("no backups found to diff against")
+		}
+		oldV = v
+	} else if oldV, err = resolveVersionRef(projectRoot, project, refs[0]); err != nil {
+		return err
+	}
+
+	warnForeignVersion(proj, oldV)
+
+	oldDir, cleanupOld, err := materializeVersion(backupRoot, cfg, oldV)
+	if err != nil {
+		return err
+	}
+	defer cleanupOld()
+	oldLabel := filepath.Base(oldV.Path)
+
+	newDir, newLabel := cwdAbs, "working"
+	if len(refs) == 2 {
+		newV, err := resolveVersionRef(projectRoot, project, refs[1])
+		if err != nil {
+			return err
+		}
+		warnForeignVersion(proj, newV)
+		dir, cleanupNew, err := materializeVersion(backupRoot, cfg, newV)
+		if err != nil {
+			return err
+		}
+		defer cleanupNew()
+		newDir, newLabel = dir, filepath.Base(newV.Path)
+	}
+
+	oldTree, err := scanTree(oldDir, ign)
+	if err != nil {
+		return err
+	}
+	newTree, err := scanTree(newDir, ign)
+	if err != nil {
+		return err
+	}
+	changes, err := diffTrees(oldTree, newTree)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s -> %s\n", oldLabel, newLabel)
+	printTreeChanges(w, changes)
+	if patch {
+		for _, c := range changes {
+			if err := printPatch(w, c, oldLabel, newLabel); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// -------------------- TREE DIFF --------------------
+
+type treeEntry struct {
+	Type    string // entryFile, entryDir or entrySymlink
+	Size    int64
+	Mode    fs.FileMode
+	MTimeNs int64
+	Link    string
+	Abs     string
+}
+
+type treeChange struct {
+	Kind byte // 'A' added, 'D' removed, 'M' modified
+	Path string
+	Old  *treeEntry
+	New  *treeEntry
+}
+
+// isInternalFile reports whether rel is bkup bookkeeping stored at the root of a
+// slot, or a work dir of a pull at the root of a working directory.
+func isInternalFile(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if strings.HasPrefix(rel, pullDirPrefix) && !strings.Contains(rel, "/") {
+		return true
+	}
+	return rel == metaFileName || rel == manifestFileName
+}
+
+// scanTree records every file and symlink below root (dirs are implied by
+// their contents), skipping ignored paths and bkup's own files.
+func scanTree(root string, ign *ignoreMatcher) (map[string]treeEntry, error) {
+	out := map[string]treeEntry{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if ign.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if isInternalFile(rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := treeEntry{
+			Size:    info.Size(),
+			Mode:    info.Mode().Perm(),
+			MTimeNs: info.ModTime().UnixNano(),
+			Abs:     path,
+		}
+		switch {
+		case d.Type()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			e.Type = entrySymlink
+			e.Link = target
+			e.Size = 0
+		case info.Mode().IsRegular():
+			e.Type = entryFile
+		default:
+			return nil
+		}
+		out[filepath.ToSlash(rel)] = e
+		return nil
+	})
+	return out, err
+}
+
+// diffTrees compares two scanned trees. Files with equal size and mtime are
+// assumed unchanged (backups preserve mtimes); otherwise contents are compared.
+func diffTrees(oldTree, newTree map[string]treeEntry) ([]treeChange, error) {
+	var out []treeChange
+	for p, o := range oldTree {
+		n, ok := newTree[p]
+		if !ok {
+			out = append(out, treeChange{Kind: 'D', Path: p, Old: &o})
+			continue
+		}
+		changed, err := entryChanged(o, n)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			out = append(out, treeChange{Kind: 'M', Path: p, Old: &o, New: &n})
+		}
+	}
+	for p, n := range newTree {
+		if _, ok := oldTree[p]; !ok {
+			out = append(out, treeChange{Kind: 'A', Path: p, New: &n})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, nil
+}
+
+func entryChanged(o, n treeEntry) (bool, error) {
+	if o.Type != n.Type || o.Mode != n.Mode {
+		return true, nil
+	}
+	if o.Type == entrySymlink {
+		return o.Link != n.Link, nil
+	}
+	if o.Size != n.Size {
+		return true, nil
+	}
+	if o.MTimeNs == n.MTimeNs {
+		return false, nil
+	}
+	same, err := sameContents(o.Abs, n.Abs)
+	return !same, err
+}
+
+func sameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 64<<10)
+	bufB := make([]byte, 64<<10)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		doneA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		doneB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if errA != nil && !doneA {
+			return false, errA
+		}
+		if errB != nil && !doneB {
+			return false, errB
+		}
+		if doneA || doneB {
+			return doneA && doneB, nil
+		}
+	}
+}
+
+// printTreeChanges prints one line per change plus a summary.
+func printTreeChanges(w io.Writer, changes []treeChange) {
+	var added, removed, modified int
+	for _, c := range changes {
+		switch c.Kind {
+		case 'A':
+			added++
+			fmt.Fprintf(w, "A  %s  (%s)\n", c.Path, formatSizeDelta(c.New.Size))
+		case 'D':
+			removed++
+			fmt.Fprintf(w, "D  %s  (%s)\n", c.Path, formatSizeDelta(-c.Old.Size))
+		case 'M':
+			modified++
+			extra := ""
+			if c.Old.Mode != c.New.Mode {
+				extra = fmt.Sprintf(", mode %o -> %o", c.Old.Mode, c.New.Mode)
+			}
+			if c.Old.Type != c.New.Type {
+				extra += fmt.Sprintf(", %s -> %s", c.Old.Type, c.New.Type)
+			}
+			fmt.Fprintf(w, "M  %s  (%s%s)\n", c.Path, formatSizeDelta(c.New.Size-c.Old.Size), extra)
+		}
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d modified\n", added, removed, modified)
+}
+
+func formatSizeDelta(d int64) string {
+	if d >= 0 {
+		return "+" + formatBytes(d)
+	}
+	return "-" + formatBytes(-d)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// -------------------- PATCH OUTPUT --------------------
+
+const patchContext = 3
+
+// maxEditDistance bounds the Myers search; beyond it a file is shown as a
+// full replacement, which is still a valid patch.
+const maxEditDistance = 2000
+
+// printPatch writes a unified diff for one change, or a "Binary files ... differ" line.
+func printPatch(w io.Writer, c treeChange, oldLabel, newLabel string) error {
+	var oldData, newData []byte
+	var err error
+	if c.Old != nil {
+		if oldData, err = readEntryForPatch(*c.Old); err != nil {
+			return err
+		}
+	}
+	if c.New != nil {
+		if newData, err = readEntryForPatch(*c.New); err != nil {
+			return err
+		}
+	}
+
+	aName, bName := oldLabel+"/"+c.Path, newLabel+"/"+c.Path
+	if c.Old == nil {
+		aName = "/dev/null"
+	}
+	if c.New == nil {
+		bName = "/dev/null"
+	}
+
+	if isBinary(oldData) || isBinary(newData) {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", aName, bName)
+		return nil
+	}
+
+	a, b := splitLines(oldData), splitLines(newData)
+	hunks := unifiedHunks(a, b)
+	if len(hunks) == 0 {
+		// Only metadata (mode) changed.
+		return nil
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", aName, bName)
+	for _, h := range hunks {
+		io.WriteString(w, h)
+	}
+	return nil
+}
+
+func readEntryForPatch(e treeEntry) ([]byte, error) {
+	if e.Type == entrySymlink {
+		return []byte(e.Link + "\n"), nil
+	}
+	return os.ReadFile(e.Abs)
+}
+
+// isBinary uses git's heuristic: a NUL byte in the first 8000 bytes.
+func isBinary(b []byte) bool {
+	if len(b) > 8000 {
+		b = b[:8000]
+	}
+	return bytes.IndexByte(b, 0) >= 0
+}
+
+// splitLines splits b into lines, keeping line endings.
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	s := string(b)
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+type editOp struct {
+	kind byte // ' ', '-', '+'
+	line string
+}
+
+// myersDiff returns the edit script turning a into b (Myers' O(ND) algorithm).
+// If more than maxEditDistance edits are needed it returns a full replacement.
+func myersDiff(a, b []string) []editOp {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > 0 {
+		offset := max + 1
+		v := make([]int, 2*max+3)
+		// trace[d] is the window v[-d-1..d+1] as it was before step d.
+		var trace [][]int
+		for d := 0; d <= max && d <= maxEditDistance; d++ {
+			trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+			for k := -d; k <= d; k += 2 {
+				var x int
+				if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+					x = v[offset+k+1]
+				} else {
+					x = v[offset+k-1] + 1
+				}
+				y := x - k
+				for x < n && y < m && a[x] == b[y] {
+					x++
+					y++
+				}
+				v[offset+k] = x
+				if x >= n && y >= m {
+					return backtrackEdits(a, b, trace)
+				}
+			}
+		}
+	}
+
+	ops := make([]editOp, 0, n+m)
+	for _, l := range a {
+		ops = append(ops, editOp{'-', l})
+	}
+	for _, l := range b {
+		ops = append(ops, editOp{'+', l})
+	}
+	return ops
+}
+
+func backtrackEdits(a, b []string, trace [][]int) []editOp {
+	x, y := len(a), len(b)
+	var rev []editOp
+	for d := len(trace) - 1; d >= 0; d-- {
+		w := trace[d]
+		at := func(k int) int { return w[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		if d == 0 {
+			prevX, prevY = 0, 0
+		}
+		for x > prevX && y > prevY {
+			x--
+			y--
+			rev = append(rev, editOp{' ', a[x]})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				rev = append(rev, editOp{'+', b[y]})
+			} else {
+				x--
+				rev = append(rev, editOp{'-', a[x]})
+			}
+		}
+	}
+	ops := make([]editOp, len(rev))
+	for i := range rev {
+		ops[i] = rev[len(rev)-1-i]
+	}
+	return ops
+}
+
+// unifiedHunks renders the edit script between a and b as unified diff hunks.
+func unifiedHunks(a, b []string) []string {
+	ops := myersDiff(a, b)
+
+	var hunks []string
+	i := 0
+	for i < len(ops) {
+		// Find the next change.
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i >= len(ops) {
+			break
+		}
+		start := i - patchContext
+		if start < 0 {
+			start = 0
+		}
+		// Extend the hunk while changes are within 2*context of each other.
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run >= len(ops) || run-end > 2*patchContext {
+				end += patchContext
+				if end > len(ops) {
+					end = len(ops)
+				}
+				break
+			}
+			end = run
+		}
+
+		// Line numbers of the hunk start in a and b.
+		aLine, bLine := 1, 1
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				aLine++
+			}
+			if op.kind != '-' {
+				bLine++
+			}
+		}
+		var body strings.Builder
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			body.WriteByte(op.kind)
+			body.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				body.WriteString("\n\\ No newline at end of file\n")
+			}
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		if aCount == 0 {
+			aLine--
+		}
+		if bCount == 0 {
+			bLine--
+		}
+		hunks = append(hunks, fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", aLine, aCount, bLine, bCount)+body.String())
+		i = end
+	}
+	return hunks
+}
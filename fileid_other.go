@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// fileID is unavailable here; every file is treated as its own copy.
+func fileID(info fs.FileInfo) (id [2]uint64, nlink uint64, ok bool) {
+	return id, 0, false
+}
+
+// fileOwner is unavailable here; the per-user temp dir is private already.
+func fileOwner(info fs.FileInfo) (uid int, ok bool) {
+	return -1, false
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileID returns the device/inode pair and link count of a file, so hard-linked
+// copies (incremental backups) are only counted once.
+func fileID(info fs.FileInfo) (id [2]uint64, nlink uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return id, 0, false
+	}
+	return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, uint64(st.Nlink), true
+}
+
+// fileOwner returns the uid that owns a file.
+func fileOwner(info fs.FileInfo) (uid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, false
+	}
+	return int(st.Uid), true
+}
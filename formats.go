@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage formats for a slot. Every slot is a directory holding .bkup_meta.json;
+// what else it holds depends on the format recorded in that meta file.
+const (
+	formatDir     = "dir"     // the tree itself
+	formatChunked = "chunked" // .bkup_manifest.json referencing $HOME/.bkup/objects
+	formatTarGz   = "tar.gz"  // data.tar.gz
+	formatTarZst  = "tar.zst" // data.tar.zst
+
+	checkoutDirName = ".checkout"
+)
+
+var knownFormats = []string{formatDir, formatChunked, formatTarGz, formatTarZst}
+
+func normalizeFormat(f string) string {
+	if strings.TrimSpace(f) == "" {
+		return formatDir
+	}
+	return strings.ToLower(strings.TrimSpace(f))
+}
+
+// storedFormat is the format new versions are written in: the configured one,
+// except that encrypted versions are never plain trees (dir becomes tar.zst).
+func storedFormat(cfg Config) string {
+	f := normalizeFormat(cfg.Format)
+	if cfg.Encryption.enabled() && f == formatDir {
+		return formatTarZst
+	}
+	return f
+}
+
+func validateFormat(f string) error {
+	nf := normalizeFormat(f)
+	for _, k := range knownFormats {
+		if nf == k {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q in config (expected one of: %s)", f, strings.Join(knownFormats, ", "))
+}
+
+// -------------------- MATERIALIZE --------------------
+
+// materializeVersion returns a directory holding the plain tree of v.
+// For dir-format slots that is the slot itself; other formats are rebuilt into
+// a temporary directory that cleanup removes.
+func materializeVersion(backupRoot string, cfg Config, v Version) (string, func(), error) {
+	if err := fetchVersion(v.Path); err != nil {
+		return "", nil, err
+	}
+	if v.Format == formatDir {
+		return v.Path, func() {}, nil
+	}
+
+	tmp, err := os.MkdirTemp("", "bkup-"+filepath.Base(v.Path)+"-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	cleanup := func() { _ = os.RemoveAll(tmp) }
+	if err := rebuildVersion(backupRoot, cfg, v, tmp); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp, cleanup, nil
+}
+
+// checkoutVersion is like materializeVersion, but rebuilds non-dir slots into a
+// persistent scratch dir (<projectRoot>/.checkout/<slot>) so the path can be
+// printed and used after bkup exits. The checkout is refreshed on every call.
+// Encrypted versions are never decrypted into the backup root: their checkout
+// lives in a private dir under the system temp dir instead.
+func checkoutVersion(backupRoot string, cfg Config, v Version) (string, error) {
+	if err := fetchVersion(v.Path); err != nil {
+		return "", err
+	}
+	if v.Format == formatDir {
+		return v.Path, nil
+	}
+	dst := filepath.Join(filepath.Dir(v.Path), checkoutDirName, filepath.Base(v.Path))
+	if v.Encrypted {
+		private, err := privateCheckoutDir()
+		if err != nil {
+			return "", err
+		}
+		dst = filepath.Join(private, filepath.Base(filepath.Dir(v.Path)), filepath.Base(v.Path))
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return "", fmt.Errorf("clear checkout: %w", err)
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return "", fmt.Errorf("create checkout: %w", err)
+	}
+	if err := rebuildVersion(backupRoot, cfg, v, dst); err != nil {
+		_ = os.RemoveAll(dst)
+		return "", err
+	}
+	return dst, nil
+}
+
+// privateCheckoutDir returns the per-user dir under the system temp dir that
+// encrypted checkouts are decrypted into, creating it if needed. Its name is
+// predictable, so another user could create it (or a symlink by that name)
+// first: it is only used if it is a real directory we own with mode 0700.
+func privateCheckoutDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("bkup-checkout-%d", os.Getuid()))
+	if err := os.Mkdir(dir, 0o700); err == nil {
+		if err := os.Chmod(dir, 0o700); err != nil { // in case the umask took bits away
+			return "", fmt.Errorf("create checkout: %w", err)
+		}
+	} else if !os.IsExist(err) {
+		return "", fmt.Errorf("create checkout: %w", err)
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", fmt.Errorf("create checkout: %w", err)
+	}
+	private := fi.IsDir()
+	if uid, ok := fileOwner(fi); ok && (uid != os.Getuid() || fi.Mode().Perm() != 0o700) {
+		private = false
+	}
+	if !private {
+		return "", fmt.Errorf("refusing to decrypt into %s: it is not a directory owned by you with mode 0700 (remove it and try again)", dir)
+	}
+	return dir, nil
+}
+
+func rebuildVersion(backupRoot string, cfg Config, v Version, dst string) error {
+	key, err := versionKey(backupRoot, cfg, v)
+	if err != nil {
+		return err
+	}
+	switch v.Format {
+	case formatChunked:
+		m, err := readManifest(v.Path, key)
+		if err != nil {
+			return err
+		}
+		return restoreChunkedTree(m, objectsDir(backupRoot), dst, key)
+	case formatTarGz, formatTarZst:
+		return extractArchive(archivePathForDir(v.Path, v.Format), v.Format, dst, key)
+	}
+	return fmt.Errorf("%s: unknown format %q", v.Path, v.Format)
+}
@@ -1,3 +1,12 @@
 module github.com/phillip-england/bkup
 
 go 1.25.3
+
+require (
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/crypto v0.50.0
+	golang.org/x/sys v0.43.0
+	golang.org/x/term v0.42.0
+)
+
+require github.com/BurntSushi/toml v1.5.0
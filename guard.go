@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// -------------------- SOURCE GUARDS --------------------
+//
+// Backing up a directory that contains the backup root (e.g. running bkup in
+// $HOME) would copy the backups into themselves, each version larger than the
+// last. So every store path inside the source is excluded like an ignored
+// path (it is never copied, diffed, watched or replaced by pull), and whole
+// machines or home directories are only backed up with --force.
+
+// guardEstimateFor bounds the walk that estimates how big a refused source is.
+const guardEstimateFor = 2 * time.Second
+
+// storePaths returns the local directories bkup keeps backups in: the backup
+// root of this run, the default data dir and every configured store. A source
+// directory must never copy these into its own backups.
+func storePaths(backupRoot string, cfg Config) []string {
+	paths := []string{mustAbs(backupRoot)}
+	if l, err := defaultLayout(); err == nil {
+		paths = append(paths, l.dataDir)
+	}
+	for _, s := range cfg.Stores {
+		if p, err := expandHome(s.Path); err == nil {
+			paths = append(paths, mustAbs(p))
+		}
+	}
+	return paths
+}
+
+// excludeStores adds a rule to ign for every store path strictly inside
+// srcDir. The rules come last, so no "!" pattern can re-include them.
+func excludeStores(ign *ignoreMatcher, srcDir, backupRoot string, cfg Config) *ignoreMatcher {
+	for _, p := range storePaths(backupRoot, cfg) {
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil || rel == "." || !insideDir(p, srcDir) {
+			continue
+		}
+		if ign == nil {
+			ign = &ignoreMatcher{}
+		}
+		ign.rules = append(ign.rules, ignoreRule{
+			re: regexp.MustCompile("^" + regexp.QuoteMeta(filepath.ToSlash(rel)) + "$"),
+		})
+	}
+	return ign
+}
+
+// guardSource refuses sources bkup should not back up: a store path itself,
+// and, unless force is set, a filesystem root or the home directory. The
+// refusal carries an estimate of what the backup would have copied.
+func guardSource(srcAbs, backupRoot string, cfg Config, ign *ignoreMatcher, force bool) error {
+	for _, p := range storePaths(backupRoot, cfg) {
+		if srcAbs == p {
+			return fmt.Errorf("%s is where bkup stores backups; it cannot be backed up into itself", srcAbs)
+		}
+	}
+	if force {
+		return nil
+	}
+
+	what := ""
+	home, _ := os.UserHomeDir()
+	switch {
+	case isFilesystemRoot(srcAbs):
+		what = "a filesystem root"
+	case home != "" && srcAbs == mustAbs(home):
+		what = "your home directory"
+	default:
+		return nil
+	}
+	files, size, complete := estimateTree(srcAbs, ign)
+	estimate := fmt.Sprintf("%d files, %s", files, formatBytes(size))
+	if !complete {
+		estimate = fmt.Sprintf("at least %d files, %s (counted for %s)",
+			files, formatBytes(size), guardEstimateFor)
+	}
+	return fmt.Errorf("refusing to back up %s, %s, without --force: it holds %s. "+
+		"Run bkup from a project directory, or pass --force if you really mean it",
+		srcAbs, what, estimate)
+}
+
+// isFilesystemRoot reports whether dir is / (a volume root on Windows) or the
+// mount point of a filesystem.
+func isFilesystemRoot(dir string) bool {
+	parent := filepath.Dir(dir)
+	if parent == dir {
+		return true
+	}
+	di, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(parent)
+	if err != nil {
+		return false
+	}
+	d, _, ok1 := fileID(di)
+	p, _, ok2 := fileID(pi)
+	return ok1 && ok2 && d[0] != p[0]
+}
+
+var errEstimateTimeout = errors.New("estimate timed out")
+
+// estimateTree counts the regular files below root that a backup would copy,
+// for at most guardEstimateFor. complete is false if it ran out of time.
+func estimateTree(root string, ign *ignoreMatcher) (files int, size int64, complete bool) {
+	deadline := time.Now().Add(guardEstimateFor)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errEstimateTimeout
+		}
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			return nil
+		}
+		if ign.Match(rel, d.IsDir()) || isInternalFile(rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				files++
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return files, size, !errors.Is(err, errEstimateTimeout)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// -------------------- HOOKS --------------------
+//
+// "hooks" (config.json or the project config) runs shell commands around every
+// backup, in the source directory:
+//   - pre_backup: before anything is copied; if it fails, no backup is taken
+//   - post_backup: once the new version is in place; if it fails, bkup warns
+//
+// Hooks get BKUP_PROJECT, BKUP_SOURCE and, after the backup, BKUP_BACKUP (the
+// new version's path). Their output goes to stderr, so bkup's stdout stays
+// the backup path.
+
+type HooksConfig struct {
+	PreBackup  string `json:"pre_backup,omitempty" toml:"pre_backup"`
+	PostBackup string `json:"post_backup,omitempty" toml:"post_backup"`
+}
+
+// runPreBackupHook runs the pre_backup hook, if any.
+func runPreBackupHook(cfg Config, p Project) error {
+	if cfg.Hooks == nil || cfg.Hooks.PreBackup == "" {
+		return nil
+	}
+	if err := runHook(cfg.Hooks.PreBackup, p, ""); err != nil {
+		return fmt.Errorf("pre_backup hook failed, no backup taken: %w", err)
+	}
+	return nil
+}
+
+// runPostBackupHook runs the post_backup hook, if any, for the version at dst.
+// The backup has succeeded at this point, so a failure only warns.
+func runPostBackupHook(cfg Config, p Project, dst string) {
+	if cfg.Hooks == nil || cfg.Hooks.PostBackup == "" {
+		return
+	}
+	if err := runHook(cfg.Hooks.PostBackup, p, dst); err != nil {
+		warnf("post_backup hook failed: %v", err)
+	}
+}
+
+func runHook(command string, p Project, dst string) error {
+	shell, flag := "/bin/sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+	cmd := exec.Command(shell, flag, command)
+	cmd.Dir = p.Source
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "BKUP_PROJECT="+p.Name, "BKUP_SOURCE="+p.Source)
+	if dst != "" {
+		cmd.Env = append(cmd.Env, "BKUP_BACKUP="+dst)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%q: %w", command, err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const ignoreFileName = ".bkupignore"
+
+// -------------------- IGNORE RULES --------------------
+//
+// Patterns follow .gitignore semantics:
+//   - blank lines and lines starting with # are skipped (\# escapes a literal #)
+//   - !pattern re-includes a path excluded by an earlier pattern (\! escapes)
+//   - a trailing / only matches directories
+//   - a pattern containing a / (other than a trailing one) is anchored to the
+//     project root; otherwise it matches at any depth
+//   - * and ? never match /, ** matches across directories
+//
+// As with git, a file cannot be re-included if one of its parent directories is
+// excluded, because excluded directories are never walked.
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// loadIgnoreMatcher builds the matcher for a project: cfg.Ignore first
+// (config.json, then the project config's patterns), then <srcDir>/.bkupignore
+// (so the file can override config),
+// then bkup's own store paths if they lie inside srcDir (see guard.go).
+// Returns nil if there are no rules at all.
+func loadIgnoreMatcher(srcDir, backupRoot string, cfg Config) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{}
+	for _, p := range cfg.Ignore {
+		if err := m.add(p); err != nil {
+			return nil, fmt.Errorf("config ignore pattern %q: %w", p, err)
+		}
+	}
+
+	p := filepath.Join(srcDir, ignoreFileName)
+	f, err := os.Open(p)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read %s: %w", p, err)
+	}
+	if err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		line := 0
+		for sc.Scan() {
+			line++
+			if err := m.add(sc.Text()); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", p, line, err)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("read %s: %w", p, err)
+		}
+	}
+
+	m = excludeStores(m, mustAbs(srcDir), backupRoot, cfg)
+	if len(m.rules) == 0 {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// add parses one gitignore-style line. Blank lines and comments are no-ops.
+func (m *ignoreMatcher) add(line string) error {
+	line = strings.TrimSuffix(line, "\r")
+	line = trimIgnoreTrailingSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	var r ignoreRule
+	switch {
+	case strings.HasPrefix(line, "!"):
+		r.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	r.re = re
+	m.rules = append(m.rules, r)
+	return nil
+}
+
+// Match reports whether rel (slash-separated, relative to the project root)
+// is ignored. The last matching rule wins.
+func (m *ignoreMatcher) Match(rel string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// trimIgnoreTrailingSpace drops trailing spaces unless escaped with a backslash.
+func trimIgnoreTrailingSpace(s string) string {
+	for strings.HasSuffix(s, " ") && !strings.HasSuffix(s, `\ `) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// globToRegexp translates a gitignore glob (without anchoring) into a regexp body.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				atStart := i == 0 || glob[i-1] == '/'
+				atEnd := i+2 == len(glob)
+				if atStart && atEnd {
+					// "**" as a whole segment at the end: everything below.
+					b.WriteString(".*")
+					i++
+					continue
+				}
+				if atStart && glob[i+2] == '/' {
+					// "**/": zero or more directories.
+					b.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				}
+				// "**" inside a segment behaves like "*".
+				b.WriteString("[^/]*")
+				i++
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			class = strings.ReplaceAll(class, `\`, `\\`)
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestIgnoreMatcher(t *testing.T) {
+	type path struct {
+		rel   string
+		isDir bool
+		want  bool
+	}
+	tests := []struct {
+		patterns []string
+		paths    []path
+	}{
+		{[]string{"*.log"}, []path{
+			{"a.log", false, true}, {"dir/sub/b.log", false, true}, {"a.log.txt", false, false}, {"logs", true, false},
+		}},
+		{[]string{"build/"}, []path{
+			{"build", true, true}, {"src/build", true, true}, {"build", false, false},
+		}},
+		{[]string{"/build"}, []path{
+			{"build", true, true}, {"build", false, true}, {"src/build", true, false},
+		}},
+		{[]string{"doc/*.txt"}, []path{
+			{"doc/a.txt", false, true}, {"doc/sub/a.txt", false, false}, {"x/doc/a.txt", false, false},
+		}},
+		{[]string{"?.txt", "[ab]*.md", "[!x]y"}, []path{
+			{"a.txt", false, true}, {"ab.txt", false, false}, {"d/c.txt", false, true},
+			{"b.md", false, true}, {"c.md", false, false}, {"zy", false, true}, {"xy", false, false},
+		}},
+		{[]string{"**/cache", "logs/**", "a/**/z"}, []path{
+			{"cache", true, true}, {"x/y/cache", true, true},
+			{"logs/a", false, true}, {"logs/a/b", false, true}, {"logs", true, false},
+			{"a/z", false, true}, {"a/b/c/z", false, true}, {"b/a/z", false, false},
+		}},
+		{[]string{"*.log", "!keep.log", "tmp/", "!tmp/"}, []path{
+			{"x.log", false, true}, {"keep.log", false, false}, {"d/keep.log", false, false}, {"tmp", true, false},
+		}},
+		{[]string{"# comment", "", `\#hash`, `\!bang`, "trailing   ", `space\ `, "crlf\r"}, []path{
+			{"# comment", false, false}, {"#hash", false, true}, {"!bang", false, true},
+			{"trailing", false, true}, {"space ", false, true}, {"space", false, false}, {"crlf", false, true},
+		}},
+	}
+	for _, tt := range tests {
+		m := &ignoreMatcher{}
+		for _, p := range tt.patterns {
+			if err := m.add(p); err != nil {
+				t.Fatalf("add(%q): %v", p, err)
+			}
+		}
+		for _, p := range tt.paths {
+			if got := m.Match(p.rel, p.isDir); got != p.want {
+				t.Errorf("patterns %q: Match(%q, dir=%v) = %v, want %v", tt.patterns, p.rel, p.isDir, got, p.want)
+			}
+		}
+	}
+
+	var none *ignoreMatcher
+	if none.Match("anything", false) {
+		t.Error("a nil matcher ignores paths")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// -------------------- DIRECTORY LAYOUT --------------------
+//
+// bkup keeps three kinds of files apart:
+//   - config: config.json, settings the user edits
+//   - state:  state.json, what bkup remembers between runs (prev_path)
+//   - data:   the default backup root (projects, objects, keyring, locks)
+//
+// On Linux and the BSDs they follow the XDG Base Directory spec:
+//   $XDG_CONFIG_HOME/bkup   (default ~/.config/bkup)
+//   $XDG_STATE_HOME/bkup    (default ~/.local/state/bkup)
+//   $XDG_DATA_HOME/bkup     (default ~/.local/share/bkup)
+// On macOS and Windows all three stay in $HOME/.bkup.
+//
+// An install from before the split ($HOME/.bkup holding config.json with
+// prev_path and the backups) is migrated the first time bkup runs: see
+// migrateLegacyLayout.
+
+const (
+	appDirName    = "bkup"
+	stateFileName = "state.json"
+)
+
+type bkupLayout struct {
+	configDir string
+	stateDir  string
+	dataDir   string
+	legacyDir string // $HOME/.bkup
+}
+
+func (l bkupLayout) configPath() string { return filepath.Join(l.configDir, configFileName) }
+func (l bkupLayout) statePath() string  { return filepath.Join(l.stateDir, stateFileName) }
+
+// xdg reports whether this platform uses the XDG layout.
+func (l bkupLayout) xdg() bool { return l.configDir != l.legacyDir }
+
+// defaultLayout returns the directories described above.
+func defaultLayout() (bkupLayout, error) {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return bkupLayout{}, errors.New("could not determine home directory")
+	}
+	legacy := filepath.Join(home, backupFolderName)
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		return bkupLayout{configDir: legacy, stateDir: legacy, dataDir: legacy, legacyDir: legacy}, nil
+	}
+	return bkupLayout{
+		configDir: xdgDir("XDG_CONFIG_HOME", home, ".config"),
+		stateDir:  xdgDir("XDG_STATE_HOME", home, ".local", "state"),
+		dataDir:   xdgDir("XDG_DATA_HOME", home, ".local", "share"),
+		legacyDir: legacy,
+	}, nil
+}
+
+// xdgDir returns $env/bkup, or $HOME/<def...>/bkup if env is unset or not an
+// absolute path (the spec says to ignore relative ones).
+func xdgDir(env, home string, def ...string) string {
+	if base := os.Getenv(env); filepath.IsAbs(base) {
+		return filepath.Join(base, appDirName)
+	}
+	return filepath.Join(append(append([]string{home}, def...), appDirName)...)
+}
+
+// -------------------- STATE --------------------
+
+// State is what bkup remembers between runs. Unlike Config it is rewritten by
+// ordinary commands, so it lives apart from the settings.
+type State struct {
+	PrevPath string `json:"prev_path"` // where `bkup go` was run from, for `bkup revert`
+}
+
+// loadState reads statePath; a missing file is an empty state.
+func loadState(statePath string) (State, error) {
+	var st State
+	b, err := os.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, fmt.Errorf("read state: %w", err)
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return State{}, fmt.Errorf("parse %s: %w", statePath, err)
+	}
+	return st, nil
+}
+
+// saveStateAtomic writes st to statePath like saveConfigAtomic does.
+func saveStateAtomic(statePath string, st State) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0o755); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	return writeFileLocked(statePath, append(b, '\n'))
+}
+
+// -------------------- MIGRATION --------------------
+
+// legacyConfig is config.json as written before state moved out of it.
+type legacyConfig struct {
+	Config
+	PrevPath string `json:"prev_path"`
+}
+
+// migrateLegacyLayout brings an install from before the split up to date:
+//   - prev_path moves from config.json to state.json
+//   - on XDG platforms, config.json moves to the config dir, and $HOME/.bkup
+//     (all backups) is renamed to the data dir. If it cannot be renamed (a
+//     different filesystem, or the data dir is already in use), the backups
+//     stay where they are and become the "default" store, so nothing is lost
+//     or copied behind the user's back.
+//
+// It runs under a lock in the state dir and does nothing once the config is in
+// place and has no prev_path.
+func migrateLegacyLayout(l bkupLayout) error {
+	if err := os.MkdirAll(l.stateDir, 0o755); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	if !needsMigration(l) {
+		return nil
+	}
+	lock, err := acquireLock(filepath.Join(l.stateDir, lockDirName, "migrate.lock"),
+		"the move of "+l.legacyDir)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	if !needsMigration(l) { // another bkup did it while we waited
+		return nil
+	}
+
+	if !l.xdg() {
+		return splitLegacyState(l, l.configPath())
+	}
+	if err := os.MkdirAll(l.configDir, 0o755); err != nil {
+		return fmt.Errorf("create config dir: %w", err)
+	}
+
+	// A previous run may have renamed the data dir and died before writing
+	// the new config; its config.json is then in the data dir.
+	from := filepath.Join(l.legacyDir, configFileName)
+	if _, err := os.Stat(from); err != nil {
+		from = filepath.Join(l.dataDir, configFileName)
+	}
+	old, err := readLegacyConfig(from)
+	if err != nil {
+		return err
+	}
+	cfg := old.Config
+
+	moved := ""
+	if fi, err := os.Stat(l.legacyDir); err == nil && fi.IsDir() {
+		if err := os.MkdirAll(filepath.Dir(l.dataDir), 0o755); err != nil {
+			return fmt.Errorf("create data dir: %w", err)
+		}
+		if err := os.Rename(l.legacyDir, l.dataDir); err == nil {
+			moved = l.dataDir
+			from = filepath.Join(l.dataDir, configFileName)
+		} else if cfg.Stores[defaultStoreName] == nil {
+			if cfg.Stores == nil {
+				cfg.Stores = map[string]*StoreConfig{}
+			}
+			cfg.Stores[defaultStoreName] = &StoreConfig{Path: l.legacyDir}
+			warnf("could not move %s to %s (%v); its backups stay there as the %q store in %s",
+				l.legacyDir, l.dataDir, err, defaultStoreName, l.configPath())
+		}
+	}
+	if moved != "" {
+		// Stores that named the old root now name the new one.
+		for _, s := range cfg.Stores {
+			if p, err := expandHome(s.Path); err == nil && mustAbs(p) == l.legacyDir {
+				s.Path = l.dataDir
+			}
+		}
+	}
+
+	if err := migratePrevPath(l, old.PrevPath); err != nil {
+		return err
+	}
+	if err := saveConfigAtomic(l.configPath(), cfg); err != nil {
+		return err
+	}
+	if err := os.Remove(from); err != nil && !os.IsNotExist(err) {
+		warnf("remove old config %s: %v", from, err)
+	}
+	fmt.Fprintf(os.Stderr, "bkup: moved to the XDG layout: config %s, state %s", l.configDir, l.stateDir)
+	if moved != "" {
+		fmt.Fprintf(os.Stderr, ", backups %s", moved)
+	}
+	fmt.Fprintln(os.Stderr)
+	return nil
+}
+
+// needsMigration reports whether migrateLegacyLayout has anything to do.
+func needsMigration(l bkupLayout) bool {
+	if _, err := os.Stat(l.configPath()); err == nil {
+		old, err := readLegacyConfig(l.configPath())
+		return err == nil && old.PrevPath != ""
+	}
+	if !l.xdg() {
+		return false
+	}
+	for _, p := range []string{filepath.Join(l.legacyDir, configFileName), filepath.Join(l.dataDir, configFileName)} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// splitLegacyState moves prev_path out of the config at cfgPath.
+func splitLegacyState(l bkupLayout, cfgPath string) error {
+	old, err := readLegacyConfig(cfgPath)
+	if err != nil {
+		return err
+	}
+	if err := migratePrevPath(l, old.PrevPath); err != nil {
+		return err
+	}
+	return saveConfigAtomic(cfgPath, old.Config)
+}
+
+// migratePrevPath stores prev from an old config in state.json, unless the
+// state already has one.
+func migratePrevPath(l bkupLayout, prev string) error {
+	if prev == "" {
+		return nil
+	}
+	st, err := loadState(l.statePath())
+	if err != nil || st.PrevPath != "" {
+		return err
+	}
+	st.PrevPath = prev
+	return saveStateAtomic(l.statePath(), st)
+}
+
+func readLegacyConfig(path string) (legacyConfig, error) {
+	var old legacyConfig
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return old, fmt.Errorf("read config: %w", err)
+	}
+	if err := json.Unmarshal(b, &old); err != nil {
+		return old, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return old, nil
+}
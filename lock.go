@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------- LOCKING --------------------
+//
+// Commands that change backups take an advisory lock in <backupRoot>/.locks:
+//   - <project>_backup.lock for backup, pull, restore, clean and prune of one project
+//   - root.lock for cleanse, gc and rekey; cleanse and gc then also take
+//     every project lock, so they never run under a backup
+//
+// config.json and state.json are written under <dir>/.locks/<file>.lock next
+// to them (writeFileLocked), so concurrent writers take turns.
+//
+// The lock file is held with flock (LockFileEx on Windows) and records the
+// owner's pid and host while held. The OS lock makes check-and-claim atomic
+// between processes on this machine and is dropped by the kernel if bkup dies;
+// the owner record covers the rest: an owner on another host (a backup root on
+// a shared disk) counts as holding the lock, and where the OS lock is
+// unavailable an owner on this host holds it for as long as its pid is alive.
+//
+// Locks are reentrant within the process (pull holds the project lock and then
+// backs up), and are taken in the order root, then projects.
+
+const (
+	lockDirName   = ".locks"
+	rootLockName  = "root.lock"
+	lockPollEvery = 250 * time.Millisecond
+)
+
+// lockWait selects what a command does when its lock is held: wait for it
+// (default, --wait) or fail at once (--no-wait).
+var lockWait = true
+
+// errLockUnsupported is returned by osLock when the platform or filesystem
+// cannot lock files; the owner record alone decides then.
+var errLockUnsupported = errors.New("file locking not supported")
+
+type lockOwner struct {
+	PID     int    `json:"pid"`
+	Host    string `json:"host"`
+	Command string `json:"command,omitempty"`
+	Since   int64  `json:"since_unix"`
+}
+
+func (o lockOwner) String() string {
+	if o.PID == 0 {
+		return "another process"
+	}
+	s := fmt.Sprintf("pid %d on %s", o.PID, o.Host)
+	if o.Command != "" {
+		s = fmt.Sprintf("%q (%s)", o.Command, s)
+	}
+	if o.Since > 0 {
+		s += ", since " + time.Unix(o.Since, 0).Format("15:04:05")
+	}
+	return s
+}
+
+type fileLock struct {
+	path string
+	what string // for messages, e.g. `project "api"`
+	f    *os.File
+	os   bool // holds the OS lock (else only the owner record)
+	refs int
+}
+
+var (
+	heldLocksMu sync.Mutex
+	heldLocks   = map[string]*fileLock{}
+)
+
+// lockProject takes the lock of project p (see above).
+func lockProject(backupRoot string, p Project) (*fileLock, error) {
+	return acquireLock(filepath.Join(backupRoot, lockDirName, filepath.Base(p.Root)+".lock"),
+		fmt.Sprintf("project %q", p.Name))
+}
+
+// lockRoot takes the lock of the whole backup root (see above).
+func lockRoot(backupRoot string) (*fileLock, error) {
+	return acquireLock(filepath.Join(backupRoot, lockDirName, rootLockName),
+		"backup root "+backupRoot)
+}
+
+// lockEverything takes the root lock and then the lock of every project under
+// backupRoot. The returned func releases them all.
+func lockEverything(backupRoot string) (func(), error) {
+	var held []*fileLock
+	release := func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].release()
+		}
+	}
+	l, err := lockRoot(backupRoot)
+	if err != nil {
+		return nil, err
+	}
+	held = append(held, l)
+
+	ents, err := os.ReadDir(backupRoot)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("read backup root: %w", err)
+	}
+	for _, e := range ents {
+		if !e.IsDir() || !strings.HasSuffix(e.Name(), "_backup") {
+			continue
+		}
+		p := Project{Name: strings.TrimSuffix(e.Name(), "_backup"), Root: filepath.Join(backupRoot, e.Name())}
+		l, err := lockProject(backupRoot, p)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, l)
+	}
+	return release, nil
+}
+
+// acquireLock takes the lock file at path, waiting for it or failing at once
+// depending on lockWait.
+func acquireLock(path, what string) (*fileLock, error) {
+	heldLocksMu.Lock()
+	if l := heldLocks[path]; l != nil {
+		l.refs++
+		heldLocksMu.Unlock()
+		return l, nil
+	}
+	heldLocksMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create lock dir: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock %s: %w", path, err)
+	}
+	l := &fileLock{path: path, what: what, f: f, refs: 1}
+
+	waiting := false
+	for {
+		owner, err := l.tryClaim()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if owner == nil {
+			break
+		}
+		if !lockWait {
+			f.Close()
+			return nil, fmt.Errorf("%s is locked by another bkup: %s; try again once it is done, "+
+				"or leave out --no-wait to wait for it%s", what, owner, staleHint(*owner, path))
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "bkup: waiting for %s, locked by %s (--no-wait fails instead)%s\n",
+				what, owner, staleHint(*owner, path))
+			waiting = true
+		}
+		time.Sleep(lockPollEvery)
+	}
+	heldLocksMu.Lock()
+	heldLocks[path] = l
+	heldLocksMu.Unlock()
+	return l, nil
+}
+
+// tryClaim makes one attempt to take the lock. It returns the current owner if
+// someone else holds it, or nil once the lock is ours.
+func (l *fileLock) tryClaim() (*lockOwner, error) {
+	got, err := osLock(l.f)
+	switch {
+	case errors.Is(err, errLockUnsupported):
+		l.os = false
+	case err != nil:
+		return nil, fmt.Errorf("lock %s: %w", l.path, err)
+	case !got:
+		owner := readLockOwner(l.f)
+		if owner == nil {
+			owner = &lockOwner{} // still writing its record
+		}
+		return owner, nil
+	default:
+		l.os = true
+	}
+
+	host, _ := os.Hostname()
+	if owner := readLockOwner(l.f); owner != nil && (owner.PID != os.Getpid() || owner.Host != host) {
+		switch {
+		case owner.Host != host:
+			// Another machine sharing this backup root: its OS lock (if any)
+			// is not visible here, and its pid cannot be checked.
+			l.unlockOS()
+			return owner, nil
+		case !l.os && processAlive(owner.PID):
+			return owner, nil
+		}
+		// Same host and either we hold the OS lock (so the owner died with
+		// it) or its pid is gone: a stale record, taken over below.
+	}
+
+	me := lockOwner{PID: os.Getpid(), Host: host, Command: lockCommand(), Since: time.Now().Unix()}
+	b, _ := json.Marshal(me)
+	err = l.f.Truncate(0)
+	if err == nil {
+		_, err = l.f.WriteAt(append(b, '\n'), 0)
+	}
+	if err != nil {
+		l.unlockOS()
+		return nil, fmt.Errorf("write lock %s: %w", l.path, err)
+	}
+	return nil, nil
+}
+
+func (l *fileLock) unlockOS() {
+	if l.os {
+		_ = osUnlock(l.f)
+		l.os = false
+	}
+}
+
+// release drops one reference; the last one clears the owner record and
+// unlocks. Releasing a nil lock does nothing.
+func (l *fileLock) release() {
+	if l == nil {
+		return
+	}
+	heldLocksMu.Lock()
+	defer heldLocksMu.Unlock()
+	if l.refs--; l.refs > 0 {
+		return
+	}
+	delete(heldLocks, l.path)
+	_ = l.f.Truncate(0)
+	l.unlockOS()
+	_ = l.f.Close()
+}
+
+func readLockOwner(f *os.File) *lockOwner {
+	b := make([]byte, 4096)
+	n, _ := f.ReadAt(b, 0)
+	var o lockOwner
+	if n == 0 || json.Unmarshal(b[:n], &o) != nil || o.PID == 0 {
+		return nil
+	}
+	return &o
+}
+
+// staleHint tells how to get rid of a lock whose owner cannot be checked from here.
+func staleHint(o lockOwner, path string) string {
+	if host, _ := os.Hostname(); o.Host == host || o.PID == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (if no bkup is running on %s anymore, delete %s)", o.Host, path)
+}
+
+// lockCommand is the command line recorded in lock files, e.g. "bkup pull 3".
+func lockCommand() string {
+	args := append([]string{"bkup"}, os.Args[1:]...)
+	s := strings.Join(args, " ")
+	if len(s) > 80 {
+		s = s[:77] + "..."
+	}
+	return s
+}
@@ -0,0 +1,14 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package main
+
+import "os"
+
+// osLock is unavailable here; the owner record in the lock file decides alone.
+func osLock(f *os.File) (bool, error) {
+	return false, errLockUnsupported
+}
+
+func osUnlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// The locked byte lies far past the owner record, so other processes can
+// still read who holds the lock (LockFileEx locks are mandatory).
+var lockRange = windows.Overlapped{OffsetHigh: 0x7fffffff}
+
+// osLock tries to take an exclusive lock on f without blocking. It reports
+// false if another process holds it.
+func osLock(f *os.File) (bool, error) {
+	ol := lockRange
+	err := windows.LockFileEx(windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &ol)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, windows.ERROR_LOCK_VIOLATION):
+		return false, nil
+	}
+	return false, err
+}
+
+func osUnlock(f *os.File) error {
+	ol := lockRange
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol)
+}
@@ -1,34 +1,137 @@
 // bkup: simple cross-platform directory backup with versioning + go/revert helpers.
 //
+// Directories (layout.go):
+//   config: $XDG_CONFIG_HOME/bkup/config.json   (default ~/.config/bkup)
+//   state:  $XDG_STATE_HOME/bkup/state.json     (default ~/.local/state/bkup; prev_path)
+//   data:   $XDG_DATA_HOME/bkup                 (default ~/.local/share/bkup; the default backup root)
+//   On macOS and Windows all three are $HOME/.bkup. An old $HOME/.bkup is migrated on first run.
+//
 // Backup root:
-//   $HOME/.bkup   (works on macOS/Linux/Windows via os.UserHomeDir)
+//   the data dir, or --root dir, --store name ("stores" in config.json), $BKUP_ROOT (see stores.go).
+//   config.json stays in the config dir, so one config drives every root.
 //
-// Layout:
-//   $HOME/.bkup/config.json
-//   $HOME/.bkup/<project>_backup/<project>_0
-//   $HOME/.bkup/<project>_backup/<project>_1
+// Layout of a backup root:
+//   <root>/.locks/root.lock, <project>_backup.lock   (see lock.go)
+//   <root>/<project>_backup/.bkup_project.json   (records the absolute source path)
+//   <root>/<project>_backup/<project>_0
+//   <root>/<project>_backup/<project>_1
 //   ...
 //
+// Projects are identified by absolute source path. A second directory with the same
+// basename (e.g. ~/work/api and ~/oss/api) gets <project>-<hash>_backup instead.
+//
 // Usage:
-//   bkup [-q]                # create a new versioned backup of current dir
-//   bkup go [--print]        # ALWAYS go to the newest version (does NOT create a new backup)
+//   bkup [-q] [-m msg] [--force] # create a new versioned backup of current dir (optionally with a message)
+//   bkup go [n|tag] [--print] # go to the newest version, or the one given (does NOT create a new backup)
 //   bkup revert [--print]    # subshell into saved "prev" location
-//   bkup list                # list backups for current project
-//   bkup pull [number] [-q]  # safety-backup current dir, then replace current dir contents with backup (default: newest)
+//   bkup list [--grep re]    # list backups (number, time, path, message) for current project
+//   bkup note <n> [text]     # set (or clear) the message of backup n
+//   bkup pin|unpin <n>       # pinned backups are never overwritten by -q
+//   bkup tag <n> <name>      # name a backup; tags work anywhere a number does
+//   bkup untag <name>        # remove a tag
+//   bkup diff [a] [b] [--patch] # compare two versions, or the current dir against a version (default: newest)
+//   bkup watch [-q] [-m msg] # back up automatically whenever the current dir settles after changes
+//   bkup pull [number] [-q]  # safety-backup current dir, then replace current dir contents with backup (default: newest; rolled back on failure)
+//   bkup restore <n> <path>... [-q] # safety-backup just those paths, then restore them from backup n
 //   bkup clean               # delete backups for current project
-//   bkup cleanse             # delete all project backups under ~/.bkup, keep config.json
-//   bkup config              # open ~/.bkup/config.json in $EDITOR (or vi / notepad)
+//   bkup cleanse             # delete all project backups in the backup root, keep the keyring
+//   bkup prune [--older-than 14d] [--keep-last 3] [--max-size 2G] [--dry-run] # delete selected versions
+//   bkup gc                  # delete chunk objects no longer referenced by any backup
+//   bkup verify [n|--all]    # re-hash stored files against the version's manifest (default: newest)
+//   bkup rekey               # change the encryption passphrase (rewraps the key, data is untouched)
+//   bkup config              # open config.json in $EDITOR (or vi / notepad); re-opened until it is valid
+//   bkup config show [--effective] # print config.json, or the merged settings of this project
+//   bkup config get|set|unset <key> [value] # read or change one setting (dotted keys: retention.keep_daily)
+//   bkup config list|validate # print every setting as key=value, or check the config files
+//   bkup help [command]      # all commands, or one command's usage and flags (also: <command> --help)
+//
+// Every command parses its own flags (cli.go); unknown flags and extra arguments are errors.
+// Global flags: --root dir (instead of the data dir), --project dir|name (instead of the current dir),
+// --wait / --no-wait (see Concurrency).
 //
 // Config (JSON):
 // {
 //   "max_versions": 10,
-//   "prev_path": "/path/you/came/from"
+//   "ignore": ["node_modules/", "*.log"],
+//   "incremental": true,
+//   "format": "dir",
+//   "copy_workers": 8,
+//   "max_pinned": 3,
+//   "retention": {"keep_last": 5, "keep_hourly": 24, "keep_daily": 7, "keep_weekly": 4, "keep_monthly": 12},
+//   "watch": {"quiet": "5s", "min_interval": "1m", "poll": "2s"},
+//   "encryption": {"enabled": true, "passphrase_env": "BKUP_PASSPHRASE", "keyfile": "~/.bkup-pass"},
+//   "backend": {"type": "s3", "bucket": "backups", "prefix": "laptop", "region": "us-east-1",
+//               "endpoint": "http://localhost:9000", "path_style": true},
+//   "stores": {"default": "~/backups", "external": "/mnt/usb/bkup",
+//              "cloud": {"path": "~/bkup-cloud", "backend": {"type": "s3", "bucket": "backups"}}},
+//   "hooks": {"pre_backup": "make clean", "post_backup": "echo $BKUP_BACKUP"}
 // }
 //
+// Project config (<project>/.bkup.json or .bkup.toml, projectconfig.go):
+// - name, max_versions, queue (-q by default), format, ignore and hooks, merged over config.json.
+//   `bkup config show --effective` prints the result and where each value came from.
+//
+// Ignore rules:
+// - gitignore-style patterns from config "ignore" plus <project>/.bkupignore (file wins on conflict).
+// - Ignored paths are never copied into a backup, and `bkup pull` leaves them alone in the working dir.
+// - The backup root is always ignored when it lies inside the source (e.g. backing up $HOME);
+//   /, $HOME and filesystem roots are refused without --force (guard.go).
+//
+// Parallel copies ("copy_workers", --jobs):
+// - Backups, pull staging and restore copy regular files with a worker pool (default 8);
+//   directory modes and mtimes are applied once their children are written.
+//
+// Concurrency (--wait, --no-wait):
+// - Backup, pull, restore, clean and prune lock the project; cleanse, gc and rekey lock the
+//   backup root. A second command waits for the lock, or fails at once with --no-wait.
+//   Config and state writes lock their own file.
+//
+// Incremental mode ("incremental": true):
+// - Files whose size, mtime and mode match the newest existing backup are hard-linked from it
+//   instead of copied (like rsync --link-dest). Every slot is still a complete tree.
+// - Deleting or overwriting a slot only drops link counts, so other versions are unaffected.
+//
 // Capacity behavior:
 // - Default (no -q): HARD CAP. If max_versions is reached, operations that need a NEW backup refuse.
 // - Queue mode (-q): FIFO. If max_versions is reached, the oldest slot is overwritten to make room.
+// - A new version is written into a hidden temp dir and swapped into its slot only once complete
+//   (slots.go), so an interrupted or failed backup never costs the version it was replacing.
 // - IMPORTANT: if max_versions is 10, backup directories will ALWAYS be numbered 0..9 (never higher).
+// - "max_versions": -1 means unlimited (numbers keep growing); 0 or missing means the default, 10.
+// - Pinned and tagged backups (`bkup pin`, `bkup tag`) are skipped by FIFO. They still use a slot;
+//   at most max_pinned (default and ceiling: max_versions-1) may be pinned or tagged, so FIFO
+//   always has a slot to reuse.
+//
+// Retention ("retention"):
+// - Grandfather-father-son pruning after every backup: keep the newest keep_last versions plus the
+//   newest version of each of the last keep_hourly hours / keep_daily days / keep_weekly ISO weeks /
+//   keep_monthly months that have a backup. Pinned, tagged and the newest version are always kept.
+// - max_versions still caps the slot count; use -1 to let retention alone decide.
+//
+// Storage formats ("format"):
+// - "dir" (default): each slot is a plain copy of the tree.
+// - "chunked": files are split into content-defined chunks stored once in <root>/objects
+//   (deduplicated across versions and projects); the slot holds .bkup_manifest.json.
+//   `bkup gc` removes chunks that no manifest references anymore.
+// - "tar.gz" / "tar.zst": the slot holds a single compressed archive (data.tar.gz / data.tar.zst).
+// - Readers (go, pull) rebuild non-dir slots into a plain tree; the format is read from each slot's
+//   meta file, so changing "format" never affects existing backups.
+//
+// Encryption ("encryption": {"enabled": true}):
+// - New versions are sealed with AES-256-GCM (names and contents); "dir" is stored as tar.zst.
+//   The random data key lives in <root>/keyring.json, wrapped with a scrypt-derived passphrase key.
+// - Passphrase: $BKUP_PASSPHRASE (or "passphrase_env"), then "keyfile", then a terminal prompt.
+// - Readers decrypt on the fly into temp dirs; .bkup_meta.json stays plaintext.
+//
+// Storage backends ("backend"):
+// - "local" (default): everything lives in the backup root.
+// - "s3": an S3-compatible bucket (SigV4, path- or virtual-host-style) mirrors the backup root,
+//   which becomes a cache: versions are uploaded when written and deleted in both places;
+//   remote-only versions are listed and downloaded on first use (see remote.go).
+//
+// Integrity:
+// - Every backup gets <backup>/.bkup_manifest.json (path, size, mode, mtime, symlink target, sha256
+//   per entry), written before .bkup_meta.json. `bkup verify` re-hashes stored data against it.
 //
 // Newest/oldest selection:
 // - Determined by a per-backup metadata file: <backup>/.bkup_meta.json (created_unix timestamp).
@@ -37,15 +140,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -59,302 +165,296 @@ const (
 )
 
 type Config struct {
-	MaxVersions int    `json:"max_versions"`
-	PrevPath    string `json:"prev_path"`
+	MaxVersions int                     `json:"max_versions"` // -1 = unlimited
+	Ignore      []string                `json:"ignore,omitempty"`
+	Incremental bool                    `json:"incremental,omitempty"`
+	Format      string                  `json:"format,omitempty"`
+	CopyWorkers int                     `json:"copy_workers,omitempty"` // parallel file copies (default 8; --jobs overrides)
+	MaxPinned   int                     `json:"max_pinned,omitempty"`   // default and ceiling: max_versions-1
+	Retention   *Retention              `json:"retention,omitempty"`    // GFS pruning after every backup
+	Watch       *WatchConfig            `json:"watch,omitempty"`        // timings for `bkup watch`
+	Encryption  *EncryptionConfig       `json:"encryption,omitempty"`   // seal new versions at rest
+	Backend     *BackendConfig          `json:"backend,omitempty"`      // off-machine copy of every version (default: local only)
+	Stores      map[string]*StoreConfig `json:"stores,omitempty"`       // named backup roots for --store
+	Hooks       *HooksConfig            `json:"hooks,omitempty"`        // commands run around every backup
 }
 
 type Meta struct {
-	CreatedUnix int64  `json:"created_unix"`
-	CreatedRFC  string `json:"created_rfc3339"`
+	CreatedUnix int64    `json:"created_unix"`
+	CreatedRFC  string   `json:"created_rfc3339"`
+	Format      string   `json:"format,omitempty"` // storage format of the slot ("" means dir)
+	SourcePath  string   `json:"source_path,omitempty"`
+	Message     string   `json:"message,omitempty"` // from -m, editable with `bkup note`
+	Pinned      bool     `json:"pinned,omitempty"`  // never evicted by -q
+	Tags        []string `json:"tags,omitempty"`    // usable instead of the backup number
+	Encrypted   bool     `json:"encrypted,omitempty"`
+	Manifest    bool     `json:"manifest,omitempty"` // a .bkup_manifest.json was written with the version
+	Paths       []string `json:"paths,omitempty"`    // set when only these paths were saved (restore's safety backup)
 }
 
 func main() {
-	args := os.Args[1:]
-
-	printMode := false
-	queueMode := false
-
-	// Strip flags anywhere: --print and -q
-	filtered := make([]string, 0, len(args))
-	for _, a := range args {
-		switch a {
-		case "--print":
-			printMode = true
-			continue
-		case "-q":
-			queueMode = true
-			continue
-		default:
-			filtered = append(filtered, a)
+	inv, err := parseCommandLine(os.Args[1:])
+	if err != nil {
+		usageFatal(err)
+	}
+	if inv.cmd.names[0] == "help" || inv.help {
+		if !inv.help {
+			err = cmdHelp(nil, inv.args)
+		} else if inv.cmd.names[0] == "help" {
+			usage()
+		} else {
+			printCommandHelp(os.Stdout, inv.cmd)
+		}
+		if err != nil {
+			usageFatal(err)
 		}
+		return
 	}
-	args = filtered
+	lockWait = !inv.opts.noWait
 
-	backupRoot, err := getBackupRoot()
+	layout, err := defaultLayout()
 	if err != nil {
 		fatal(err)
 	}
-	if err := os.MkdirAll(backupRoot, 0o755); err != nil {
-		fatal(fmt.Errorf("create backup root: %w", err))
+	if err := migrateLegacyLayout(layout); err != nil {
+		fatal(fmt.Errorf("migrate %s: %w", layout.legacyDir, err))
+	}
+	if err := os.MkdirAll(layout.configDir, 0o755); err != nil {
+		fatal(fmt.Errorf("create config dir: %w", err))
+	}
+	cfgPath := layout.configPath()
+	// bkup config must work on a broken config.json: it is how it gets fixed.
+	configCmd := inv.cmd.names[0] == "config"
+	cfg, cfgErr := loadOrInitConfig(cfgPath)
+	if cfgErr != nil {
+		if !configCmd {
+			fatal(fmt.Errorf("%w (fix it with `bkup config`)", cfgErr))
+		}
+		cfg = Config{MaxVersions: 10}
 	}
 
-	cfgPath := filepath.Join(backupRoot, configFileName)
-	cfg, err := loadOrInitConfig(cfgPath)
+	root, err := selectBackupRoot(cfg, inv.opts.root, inv.opts.store)
 	if err != nil {
 		fatal(err)
 	}
-
-	switch {
-	case len(args) == 0:
-		// bkup [-q]
-		cwd, err := os.Getwd()
-		if err != nil {
-			fatal(err)
-		}
-		dst, err := backupNewVersion(cwd, backupRoot, cfg, queueMode, nil)
-		if err != nil {
-			fatal(err)
-		}
-		fmt.Println(dst)
-
-	case args[0] == "config":
-		// bkup config
-		if err := ensureConfigExists(cfgPath, cfg); err != nil {
-			fatal(err)
-		}
-		if err := openEditor(cfgPath); err != nil {
-			fatal(err)
-		}
-
-	case args[0] == "go":
-		// bkup go [--print]
-		//
-		// Per your spec: go does NOT create a new backup (except first-run where none exist).
-		// It jumps to the newest existing backup, determined by .bkup_meta.json timestamps.
-		cwd, err := os.Getwd()
-		if err != nil {
-			fatal(err)
-		}
-		cwdAbs := mustAbs(cwd)
-		project := filepath.Base(cwdAbs)
-		projectRoot := filepath.Join(backupRoot, project+"_backup")
-
-		latest, err := newestBackupPath(projectRoot, project)
-		if err != nil {
-			fatal(err)
-		}
-		if latest == "" {
-			created, err := backupNewVersion(cwdAbs, backupRoot, cfg, queueMode, nil)
-			if err != nil {
-				fatal(err)
-			}
-			latest = created
-		}
-
-		// Save previous location in config.
-		cfg.PrevPath = cwdAbs
-		if err := saveConfigAtomic(cfgPath, cfg); err != nil {
-			fatal(err)
-		}
-
-		if printMode {
-			fmt.Println(latest)
-			return
-		}
-		if err := openSubshell(latest); err != nil {
-			fatal(err)
-		}
-
-	case args[0] == "revert":
-		// bkup revert [--print]
-		cfg, err := loadOrInitConfig(cfgPath)
-		if err != nil {
-			fatal(err)
-		}
-		if strings.TrimSpace(cfg.PrevPath) == "" {
-			fatal(fmt.Errorf("prev_path is empty in %s (run `bkup go` first)", cfgPath))
-		}
-
-		if printMode {
-			fmt.Println(cfg.PrevPath)
-			return
-		}
-		if err := openSubshell(cfg.PrevPath); err != nil {
-			fatal(err)
-		}
-
-	case args[0] == "list":
-		// bkup list
-		cwd, err := os.Getwd()
-		if err != nil {
-			fatal(err)
-		}
-		project := filepath.Base(mustAbs(cwd))
-		projectRoot := filepath.Join(backupRoot, project+"_backup")
-
-		vers, err := listProjectVersions(projectRoot, project)
-		if err != nil {
-			fatal(err)
-		}
-		if len(vers) == 0 {
-			fmt.Println("(no backups found)")
-			return
-		}
-		sort.Slice(vers, func(i, j int) bool { return vers[i].N < vers[j].N })
-		for _, v := range vers {
-			fmt.Println(v.Path)
-		}
-
-	case args[0] == "pull":
-		// bkup pull [number] [-q]
-		cwd, err := os.Getwd()
-		if err != nil {
+	backupRoot := root.path
+	if err := os.MkdirAll(backupRoot, 0o755); err != nil {
+		fatal(fmt.Errorf("create backup root: %w", err))
+	}
+	if err := attachBackend(backupRoot, root.backend); err != nil {
+		err = fmt.Errorf("%s: %w", cfgPath, err)
+		if !configCmd {
 			fatal(err)
 		}
-		cwdAbs := mustAbs(cwd)
-		project := filepath.Base(cwdAbs)
-		projectRoot := filepath.Join(backupRoot, project+"_backup")
-
-		var n int
-		var pullSrc string
-		if len(args) < 2 {
-			vers, err := listProjectVersions(projectRoot, project)
-			if err != nil {
-				fatal(err)
-			}
-			if len(vers) == 0 {
-				fatal(errors.New("no backups found to pull"))
-			}
-			sort.Slice(vers, func(i, j int) bool {
-				// Newest first; tie-breaker: higher N.
-				if vers[i].CreatedUnix == vers[j].CreatedUnix {
-					return vers[i].N > vers[j].N
-				}
-				return vers[i].CreatedUnix > vers[j].CreatedUnix
-			})
-			n = vers[0].N
-			pullSrc = vers[0].Path
-		} else {
-			n, err = strconv.Atoi(args[1])
-			if err != nil || n < 0 {
-				fatal(fmt.Errorf("invalid backup number: %q", args[1]))
-			}
-			pullSrc = filepath.Join(projectRoot, fmt.Sprintf("%s_%d", project, n))
-
-			// Ensure requested backup exists BEFORE doing anything else.
-			if fi, err := os.Stat(pullSrc); err != nil || !fi.IsDir() {
-				if err != nil {
-					fatal(fmt.Errorf("backup not found: %s (%w)", pullSrc, err))
-				}
-				fatal(fmt.Errorf("backup not found (not a directory): %s", pullSrc))
-			}
-		}
-
-		// Never overwrite the backup we're pulling FROM.
-		protected := map[int]bool{n: true}
-
-		// Create safety backup first (hard-cap may refuse; -q may overwrite oldest excluding protected).
-		safetyDst, err := backupNewVersion(cwdAbs, backupRoot, cfg, queueMode, protected)
-		if err != nil {
-			fatal(fmt.Errorf("refusing to pull because a safety backup cannot be created first: %w", err))
-		}
+		cfgErr = errors.Join(cfgErr, err)
+	}
 
-		// Replace current directory contents with the pulled backup.
-		if err := replaceDirContents(cwdAbs, pullSrc); err != nil {
+	cwd, err := os.Getwd()
+	if err != nil {
+		fatal(err)
+	}
+	e := &env{
+		name:       inv.name,
+		opts:       inv.opts,
+		backupRoot: backupRoot,
+		cfgPath:    cfgPath,
+		statePath:  layout.statePath(),
+		global:     cfg,
+		cfg:        cfg,
+		cfgErr:     cfgErr,
+		cwd:        mustAbs(cwd),
+		src:        mustAbs(cwd),
+	}
+	if inv.opts.project != "" {
+		if e.src, err = resolveProjectArg(backupRoot, inv.opts.project); err != nil {
 			fatal(err)
 		}
-
-		fmt.Printf("Pulled %s into %s\n", pullSrc, cwdAbs)
-		fmt.Printf("Safety backup created: %s\n", safetyDst)
-
-	case args[0] == "clean":
-		// bkup clean (single project)
-		cwd, err := os.Getwd()
-		if err != nil {
+	}
+	if e.projectCfg, err = loadProjectConfig(e.src); err != nil {
+		if !configCmd {
 			fatal(err)
 		}
-		project := filepath.Base(mustAbs(cwd))
-		projectRoot := filepath.Join(backupRoot, project+"_backup")
-
-		if err := os.RemoveAll(projectRoot); err != nil {
-			fatal(fmt.Errorf("remove project backups: %w", err))
-		}
-		fmt.Println("Removed:", projectRoot)
-
-	case args[0] == "cleanse":
-		// bkup cleanse (entire backup root except config.json)
-		removed, err := cleanseBackupRoot(backupRoot, cfgPath)
-		if err != nil {
-			fatal(err)
+		e.cfgErr = errors.Join(e.cfgErr, err)
+	}
+	e.cfg = e.projectCfg.apply(cfg)
+	if pc := e.projectCfg; pc != nil && pc.Queue != nil && !inv.opts.given["q"] {
+		e.opts.queue = *pc.Queue
+	}
+	if err := inv.cmd.run(e, inv.args); err != nil {
+		var ue *usageError
+		if errors.As(err, &ue) {
+			usageFatal(err)
 		}
-		fmt.Printf("Cleansed %d item(s). Kept %s.\n", removed, cfgPath)
-
-	case len(args) >= 1 && (args[0] == "-h" || args[0] == "--help" || args[0] == "help"):
-		usage()
-
-	default:
-		usage()
-		os.Exit(2)
+		fatal(err)
 	}
 }
 
 func usage() {
-	fmt.Println(`bkup - versioned directory backups into a cross-platform backup location
+	fmt.Print(`bkup - versioned directory backups into a cross-platform backup location
 
 Usage:
-  bkup [-q]
-      Create a new versioned backup of the current directory:
-      $HOME/.bkup/<dirname>_backup/<dirname>_<N>
-
-  bkup go [--print]
-      Go to the newest existing backup for the current project (does NOT create a new backup).
-      If no backups exist yet, it creates the first one.
-      "Newest" is determined by <backup>/.bkup_meta.json timestamps.
-      With --print: just print the newest backup directory path.
-
-  bkup revert [--print]
-      Open a subshell in prev_path stored in config.json.
-      With --print: just print the prev_path.
-
-  bkup list
-      List all backups for the current project.
-
-  bkup pull [number] [-q]
-      Safety-backup the current directory (so you can undo), then replace the current
-      directory contents with the chosen backup version. If no number is provided,
-      the newest backup is used. Your current path stays the same.
-      - Default: refuses if max_versions is reached (to avoid data loss).
-      - With -q: overwrites the oldest backup (FIFO) to make room.
-
-  bkup clean
-      Delete all backups for the current project only.
-
-  bkup cleanse
-      Delete everything under $HOME/.bkup except config.json.
-
-  bkup config
-      Open $HOME/.bkup/config.json in $EDITOR (or vi / notepad).
-
+`)
+	for _, c := range commands {
+		for _, u := range c.usage {
+			fmt.Printf("  bkup %s\n", u)
+		}
+		help := strings.TrimPrefix(c.help, "\n")
+		fmt.Printf("      %s\n\n", strings.ReplaceAll(help, "\n", "\n      "))
+	}
+	fmt.Println("Global flags (every command; `bkup <command> --help` lists its own flags too):")
+	printFlags(os.Stdout, globalFlags)
+	fmt.Print(`
 Queue mode (-q):
   Treat backups like a FIFO queue. When max_versions is reached, the oldest backup
-  is overwritten to allow creating a new backup.
+  that is not pinned is overwritten to allow creating a new backup. The old backup is
+  only replaced once the new one is complete: if bkup is interrupted (Ctrl-C, full
+  disk, ...) it stays as it was, and the next backup cleans up the leftovers.
+
+Project identity:
+  Backups belong to the absolute path of the directory they were taken from. Two
+  directories with the same name (e.g. ~/work/api and ~/oss/api) get separate backup
+  dirs (api_backup and api-<hash>_backup). Existing <name>_backup dirs from older
+  versions of bkup are adopted by the first directory that uses them, and bkup warns
+  whenever a backup's recorded source path differs from the current directory.
 
 Numbering rule:
   If max_versions is 10, backups are always numbered 0..9 (never higher).
+  "max_versions": -1 removes the cap (numbers keep growing).
+
+Retention:
+  Add a "retention" block to config.json to prune old backups after every backup,
+  grandfather-father-son style:
+    "retention": {"keep_last": 5, "keep_hourly": 24, "keep_daily": 7,
+                  "keep_weekly": 4, "keep_monthly": 12}
+  Keeps the newest keep_last backups, plus the newest backup of each of the last
+  keep_hourly hours, keep_daily days, keep_weekly weeks and keep_monthly months that
+  have one. Pinned and tagged backups and the newest backup are never pruned. max_versions still
+  limits the number of slots; combine retention with "max_versions": -1 to let the
+  policy alone decide.
+
+Files and directories:
+  config.json (settings)  $XDG_CONFIG_HOME/bkup   default ~/.config/bkup
+  state.json (prev_path)  $XDG_STATE_HOME/bkup    default ~/.local/state/bkup
+  backups                 $XDG_DATA_HOME/bkup     default ~/.local/share/bkup
+  On macOS and Windows all three are $HOME/.bkup. An existing $HOME/.bkup is moved
+  into this layout the first time bkup runs; if it cannot be moved (another disk),
+  its backups stay where they are and become the "default" store.
+
+Backup root and stores (--root dir, --store name, $BKUP_ROOT):
+  Backups go to the data dir unless another root is chosen, in this order: --root dir,
+  --store name, $BKUP_ROOT, then the store named "default". Stores are named roots
+  in config.json:
+    "stores": {"default": "~/backups", "external": "/mnt/usb/bkup", "scratch": "/data/bkup"}
+  config.json itself always stays in the config dir, so every root shares one config
+  (ignore rules, formats, ...). Each root has its own keyring and locks.
+  A store can also be {"path": "...", "backend": {...}} to mirror it to its own
+  bucket or prefix; the top-level "backend" is used for every other root.
+
+Parallel copies (--jobs n, "copy_workers": n):
+  Backups, pull and restore copy up to 8 files at once (default). Set "copy_workers"
+  in config.json, or pass --jobs n to a command that copies, to change that; 1 copies one file
+  at a time. The first failed copy stops the others and is the error reported.
+
+Concurrent runs (--wait, --no-wait):
+  Commands that change backups lock them first (in <backup root>/.locks): backup, pull,
+  restore, clean and prune lock the current project; cleanse, gc and rekey lock
+  everything. Writes of config.json and state.json take turns too. A second command waits and says who it is waiting for
+  (default, --wait); with --no-wait it fails at once instead. Locks are released if
+  bkup dies; a lock recorded by another host is honored until that host releases it.
+
+Incremental backups:
+  Set "incremental": true in config.json to hard-link files that are unchanged since
+  the newest backup instead of copying them. Note that linked files share storage, so
+  editing a file in place inside a backup (e.g. from a "bkup go" subshell) changes it in
+  every version that links to it.
+
+Storage format:
+  "format": "dir" (default) stores each version as a plain directory copy.
+  "format": "chunked" splits files into content-defined chunks stored once in
+  <backup root>/objects (shared by all projects); each version is then just a manifest.
+  "format": "tar.gz" or "tar.zst" stores each version as a single compressed archive.
+  go/pull rebuild chunked and archived versions into a plain tree transparently (the
+  go subshell uses a temp dir, go --print a scratch checkout under <project>_backup/.checkout).
+
+Encryption:
+  "encryption": {"enabled": true} seals new backups (file names and contents) with
+  AES-256-GCM; "dir" backups are stored as tar.zst. The passphrase is read from
+  $BKUP_PASSPHRASE (or the variable named by "passphrase_env"), then from the file in
+  "keyfile", then asked for on the terminal; the first encrypted backup sets it.
+  go, pull, diff, restore and verify decrypt on the fly (go uses a private temp dir).
+  Backup times, messages, pins and tags stay readable.
+
+Remote storage:
+  A "backend" block in config.json keeps a copy of every backup in an S3-compatible
+  object store (AWS S3, MinIO, ...):
+    "backend": {"type": "s3", "bucket": "backups", "prefix": "laptop",
+                "endpoint": "http://localhost:9000", "path_style": true}
+  Credentials come from "access_key_id"/"secret_access_key" or $AWS_ACCESS_KEY_ID /
+  $AWS_SECRET_ACCESS_KEY. The backup root then acts as a local cache: new backups are
+  uploaded after they are written, note/pin/tag changes and deletions (clean, cleanse,
+  prune, retention, -q overwrites) are applied to both, and backups that exist only
+  remotely are listed with [remote] and downloaded the first time they are used.
+  A failed upload only warns; the local backup is kept.
+
+Changing settings (bkup config ...):
+  bkup config opens config.json in $EDITOR and checks it when the editor exits;
+  if it is invalid you can edit again or keep the old file. Without an editor:
+    bkup config set retention.keep_daily 7
+    bkup config get max_versions
+    bkup config unset watch.poll
+    bkup config list
+    bkup config validate
+  Values are checked against each setting's type before anything is written.
+
+Project settings (.bkup.json or .bkup.toml in the project):
+  Override name, max_versions, format and hooks, add ignore patterns, or set
+  "queue": true to make -q the default for this project, e.g. in .bkup.toml:
+    max_versions = 3
+    queue = true
+    ignore = ["data/"]
+  bkup config show --effective prints the merged settings and where each comes from.
+
+Hooks ("hooks": {"pre_backup": "...", "post_backup": "..."}):
+  Shell commands run in the project directory around every backup. A failing
+  pre_backup cancels the backup; a failing post_backup only warns. They get
+  $BKUP_PROJECT, $BKUP_SOURCE and (post_backup) $BKUP_BACKUP.
+
+Ignoring files:
+  Put gitignore-style patterns in <project>/.bkupignore and/or the "ignore" list in
+  config.json or the project config. Ignored paths are skipped when backing up and
+  left untouched by pull.
 `)
 }
 
+// exitStatus is returned by a command that has already reported its failure
+// (verify's FAILED lines): fatal exits with that status and prints nothing.
+type exitStatus int
+
+func (e exitStatus) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
 func fatal(err error) {
+	var es exitStatus
+	if errors.As(err, &es) {
+		os.Exit(int(es))
+	}
 	fmt.Fprintln(os.Stderr, "bkup error:", err)
+	var ie *interruptedError
+	if errors.As(err, &ie) {
+		os.Exit(ie.exitCode())
+	}
 	os.Exit(1)
 }
 
-func getBackupRoot() (string, error) {
-	home, err := os.UserHomeDir()
-	if err != nil || home == "" {
-		return "", errors.New("could not determine home directory")
+// usageFatal reports a bad command line and exits 2.
+func usageFatal(err error) {
+	fmt.Fprintln(os.Stderr, "bkup error:", err)
+	var ue *usageError
+	if errors.As(err, &ue) && ue.cmd != nil {
+		fmt.Fprintf(os.Stderr, "Run 'bkup %s --help' for usage.\n", ue.cmd.names[0])
+	} else {
+		fmt.Fprintln(os.Stderr, "Run 'bkup help' for usage.")
 	}
-	return filepath.Join(home, backupFolderName), nil
+	os.Exit(2)
 }
 
 func mustAbs(p string) string {
@@ -370,7 +470,6 @@ func mustAbs(p string) string {
 func loadOrInitConfig(cfgPath string) (Config, error) {
 	def := Config{
 		MaxVersions: 10,
-		PrevPath:    "",
 	}
 
 	b, err := os.ReadFile(cfgPath)
@@ -384,13 +483,51 @@ func loadOrInitConfig(cfgPath string) (Config, error) {
 		return Config{}, fmt.Errorf("read config: %w", err)
 	}
 
+	cfg, err := parseConfig(cfgPath, b, false)
+	if err != nil {
+		return Config{}, err
+	}
+	// 0 (or a missing key) means the default; any negative value means unlimited.
+	if cfg.MaxVersions == 0 {
+		cfg.MaxVersions = def.MaxVersions
+	}
+	return cfg, nil
+}
+
+// parseConfig decodes and checks the contents b of cfgPath. strict is for
+// config get/set/validate and the editor: unknown keys are errors then, and
+// settings only used by some commands (format, watch, backend) are checked
+// too, so mistakes show up when they are made.
+func parseConfig(cfgPath string, b []byte, strict bool) (Config, error) {
 	var cfg Config
-	if err := json.Unmarshal(b, &cfg); err != nil {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(&cfg); err != nil {
 		return Config{}, fmt.Errorf("parse %s: %w", cfgPath, err)
 	}
+	if dec.More() {
+		return Config{}, fmt.Errorf("parse %s: unexpected data after the top-level object", cfgPath)
+	}
 
-	if cfg.MaxVersions <= 0 {
-		cfg.MaxVersions = def.MaxVersions
+	check := []error{cfg.Retention.validate(), validateStores(cfg.Stores)}
+	if cfg.CopyWorkers < 0 {
+		check = append(check, errors.New("copy_workers must not be negative"))
+	}
+	if strict {
+		_, werr := cfg.Watch.timings()
+		check = append(check, validateFormat(cfg.Format), werr, validateBackend("backend", cfg.Backend))
+		for _, name := range sortedStoreNames(cfg.Stores) {
+			if st := cfg.Stores[name]; st != nil {
+				check = append(check, validateBackend("stores."+name+".backend", st.Backend))
+			}
+		}
+	}
+	for _, err := range check {
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %w", cfgPath, err)
+		}
 	}
 	return cfg, nil
 }
@@ -406,18 +543,45 @@ func ensureConfigExists(cfgPath string, cfg Config) error {
 	return saveConfigAtomic(cfgPath, cfg)
 }
 
+// saveConfigAtomic writes cfg to cfgPath with writeFileLocked.
 func saveConfigAtomic(cfgPath string, cfg Config) error {
-	tmp := cfgPath + ".tmp"
 	b, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshal config: %w", err)
 	}
-	b = append(b, '\n')
+	return writeFileLocked(cfgPath, append(b, '\n'))
+}
 
-	if err := os.WriteFile(tmp, b, 0o644); err != nil {
-		return fmt.Errorf("write temp config: %w", err)
+// writeFileLocked writes b to a uniquely named temp file and renames it over
+// path, holding <dir>/.locks/<name>.lock so concurrent writers take turns.
+func writeFileLocked(path string, b []byte) error {
+	lock, err := acquireLock(filepath.Join(filepath.Dir(path), lockDirName, filepath.Base(path)+".lock"), path)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp %s: %w", filepath.Base(path), err)
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0o644)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write temp %s: %w", filepath.Base(path), err)
 	}
-	return os.Rename(tmp, cfgPath)
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
 }
 
 // -------------------- META --------------------
@@ -426,11 +590,19 @@ func metaPathForDir(backupDir string) string {
 	return filepath.Join(backupDir, metaFileName)
 }
 
-func writeMetaAtomic(backupDir string, created time.Time) error {
-	m := Meta{
+func newMeta(created time.Time, format, sourcePath string) Meta {
+	if format == formatDir {
+		format = ""
+	}
+	return Meta{
 		CreatedUnix: created.Unix(),
 		CreatedRFC:  created.UTC().Format(time.RFC3339),
+		Format:      format,
+		SourcePath:  sourcePath,
 	}
+}
+
+func writeMetaAtomic(backupDir string, m Meta) error {
 	b, err := json.MarshalIndent(m, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshal meta: %w", err)
@@ -445,29 +617,52 @@ func writeMetaAtomic(backupDir string, created time.Time) error {
 	return os.Rename(tmp, p)
 }
 
-// readCreatedUnix reads .bkup_meta.json created_unix.
-// Returns (createdUnix, true, nil) if present.
-// If missing/unreadable, returns (fallback, false, nil) where fallback is dir modtime unix if stat succeeds.
-func readCreatedUnix(backupDir string) (int64, bool, error) {
+// updateMeta applies fn to a backup's meta and rewrites it atomically, keeping
+// every other field (a missing meta file is created from the readMeta fallback).
+func updateMeta(backupDir string, fn func(*Meta)) error {
+	if err := fetchVersion(backupDir); err != nil {
+		return err
+	}
+	m, hasMeta, err := readMeta(backupDir)
+	if err != nil {
+		return err
+	}
+	if !hasMeta && m.CreatedRFC == "" {
+		m.CreatedRFC = time.Unix(m.CreatedUnix, 0).UTC().Format(time.RFC3339)
+	}
+	fn(&m)
+	if err := writeMetaAtomic(backupDir, m); err != nil {
+		return err
+	}
+	if err := pushFile(slotRoot(backupDir), metaPathForDir(backupDir)); err != nil {
+		return fmt.Errorf("upload meta: %w", err)
+	}
+	return nil
+}
+
+// readMeta reads .bkup_meta.json.
+// Returns (meta, true, nil) if present with a created_unix.
+// If missing/unreadable, returns (meta, false, nil) where meta.CreatedUnix falls back
+// to the dir modtime unix if stat succeeds (or 0 if both fail).
+func readMeta(backupDir string) (Meta, bool, error) {
 	p := metaPathForDir(backupDir)
+	var m Meta
 	b, err := os.ReadFile(p)
 	if err == nil {
-		var m Meta
 		if err := json.Unmarshal(b, &m); err != nil {
-			return 0, false, fmt.Errorf("parse meta %s: %w", p, err)
+			return Meta{}, false, fmt.Errorf("parse meta %s: %w", p, err)
 		}
 		if m.CreatedUnix > 0 {
-			return m.CreatedUnix, true, nil
+			return m, true, nil
 		}
 	}
 
 	// fallback to directory modtime
 	fi, statErr := os.Stat(backupDir)
 	if statErr == nil {
-		return fi.ModTime().Unix(), false, nil
+		m.CreatedUnix = fi.ModTime().Unix()
 	}
-	// if both fail, treat as 0
-	return 0, false, nil
+	return m, false, nil
 }
 
 // -------------------- BACKUP LOGIC --------------------
@@ -477,50 +672,95 @@ type Version struct {
 	Path        string
 	CreatedUnix int64 // from .bkup_meta.json (preferred), else dir modtime unix
 	HasMeta     bool
+	Format      string // one of knownFormats
+	SourcePath  string // absolute source dir recorded at backup time ("" for legacy backups)
+	Message     string
+	Pinned      bool
+	Tags        []string
+	Encrypted   bool
+	HasManifest bool     // meta says a manifest was written (see expectsManifest)
+	Paths       []string // non-empty for a partial version holding only these paths
+	Remote      bool     // only on the remote backend so far; fetched on first use
+}
+
+// partial reports whether v holds only some paths of the project, so it must
+// never stand in for the whole tree (newest version, pull, incremental links).
+func (v Version) partial() bool { return len(v.Paths) > 0 }
+
+type backupOptions struct {
+	queueMode     bool          // -q: FIFO-overwrite the oldest slot when full
+	protectedNums map[int]bool  // slots that must never be overwritten
+	only          *pathSelector // back up just these paths (nil = the whole tree)
+	message       string        // stored in the new version's meta
+	jobs          int           // parallel file copies (--jobs; 0 = copy_workers)
+	force         bool          // --force: allow backing up $HOME or a filesystem root
 }
 
 // backupNewVersion creates a new backup version.
 //
-// Numbering rule when MaxVersions > 0:
+// Numbering rule when MaxVersions > 0 (negative means unlimited: numbers keep growing):
 //   - Directories are ALWAYS in the range 0..MaxVersions-1.
 //   - No "-q": if all slots are taken, refuse.
 //   - "-q": overwrite the oldest slot (FIFO) to make room (excluding protectedNums).
 //
-// protectedNums (optional) prevents overwriting certain slot numbers.
-func backupNewVersion(srcAbs string, backupRoot string, cfg Config, queueMode bool, protectedNums map[int]bool) (string, error) {
-	srcAbs = mustAbs(srcAbs)
-	project := filepath.Base(srcAbs)
+// Afterwards cfg.Retention (if any) prunes versions it does not keep.
+//
+// opts.protectedNums (optional) prevents overwriting certain slot numbers.
+func backupNewVersion(srcAbs string, backupRoot string, cfg Config, opts backupOptions) (string, error) {
+	queueMode, protectedNums := opts.queueMode, opts.protectedNums
 
-	projectRoot := filepath.Join(backupRoot, project+"_backup")
-	if err := os.MkdirAll(projectRoot, 0o755); err != nil {
-		return "", fmt.Errorf("create project root: %w", err)
+	srcAbs = mustAbs(srcAbs)
+	proj, err := resolveProject(backupRoot, srcAbs)
+	if err != nil {
+		return "", err
+	}
+	project, projectRoot := proj.Name, proj.Root
+	lock, err := lockProject(backupRoot, proj)
+	if err != nil {
+		return "", err
+	}
+	defer lock.release()
+	if err := ensureProjectRoot(proj); err != nil {
+		return "", err
 	}
+	recoverSlots(projectRoot)
 
 	vers, err := listProjectVersions(projectRoot, project)
 	if err != nil {
 		return "", err
 	}
 
-	// Unlimited mode (MaxVersions <= 0): keep growing (legacy behavior).
-	if cfg.MaxVersions <= 0 {
+	ign, err := loadIgnoreMatcher(srcAbs, backupRoot, cfg)
+	if err != nil {
+		return "", err
+	}
+	if opts.only == nil {
+		if err := guardSource(srcAbs, backupRoot, cfg, ign, opts.force); err != nil {
+			return "", err
+		}
+	}
+	if err := validateFormat(cfg.Format); err != nil {
+		return "", err
+	}
+
+	// Unlimited mode (max_versions: -1): keep growing.
+	if cfg.MaxVersions < 0 {
 		next := 0
 		if len(vers) > 0 {
 			sort.Slice(vers, func(i, j int) bool { return vers[i].N < vers[j].N })
 			next = vers[len(vers)-1].N + 1
 		}
 		dst := filepath.Join(projectRoot, fmt.Sprintf("%s_%d", project, next))
-		_ = os.RemoveAll(dst)
-		if err := os.MkdirAll(dst, 0o755); err != nil {
-			return "", fmt.Errorf("create dest: %w", err)
-		}
-		if err := copyDirContents(srcAbs, dst); err != nil {
-			_ = os.RemoveAll(dst)
+		copyOpts := copyOptions{ignore: ign, only: opts.only, linkDest: linkDestFor(cfg, vers, next), workers: copyWorkers(cfg, opts.jobs)}
+		if err := runPreBackupHook(cfg, proj); err != nil {
 			return "", err
 		}
-		if err := writeMetaAtomic(dst, time.Now()); err != nil {
-			_ = os.RemoveAll(dst)
+		if err := writeVersion(srcAbs, dst, backupRoot, cfg, copyOpts, opts.message); err != nil {
 			return "", err
 		}
+		uploadVersion(dst)
+		pruneAfterBackup(proj, cfg, protectedNums)
+		runPostBackupHook(cfg, proj, dst)
 		return dst, nil
 	}
 
@@ -551,25 +791,25 @@ func backupNewVersion(srcAbs string, backupRoot string, cfg Config, queueMode bo
 		if !queueMode {
 			return "", fmt.Errorf(
 				"max_versions reached (%d) for project %q; refusing to create a new backup. "+
-					"Use -q to enable FIFO overwrite, increase max_versions in %s, or run `bkup clean`.",
-				max, project, filepath.Join(backupRoot, configFileName),
+					"Use -q to enable FIFO overwrite, increase max_versions in %s (or the project's %s), or run `bkup clean`.",
+				max, project, configFileName, projectConfigJSON,
 			)
 		}
 
-		// Queue mode: overwrite oldest by CreatedUnix (excluding protected).
+		// Queue mode: overwrite oldest by CreatedUnix (excluding pinned, tagged and protected).
 		candidates := make([]Version, 0, max)
 		for i := 0; i < max; i++ {
 			v, ok := used[i]
 			if !ok {
 				continue
 			}
-			if protectedNums != nil && protectedNums[v.N] {
+			if v.exempt() || (protectedNums != nil && protectedNums[v.N]) {
 				continue
 			}
 			candidates = append(candidates, v)
 		}
 		if len(candidates) == 0 {
-			return "", fmt.Errorf("queue mode: cannot overwrite any backups (all slots are protected); refusing")
+			return "", fmt.Errorf("queue mode: cannot overwrite any backups (all slots are pinned, tagged or protected); refusing")
 		}
 
 		sort.Slice(candidates, func(i, j int) bool {
@@ -587,35 +827,141 @@ func backupNewVersion(srcAbs string, backupRoot string, cfg Config, queueMode bo
 	}
 
 	dst := filepath.Join(projectRoot, fmt.Sprintf("%s_%d", project, slot))
+	copyOpts := copyOptions{ignore: ign, only: opts.only, linkDest: linkDestFor(cfg, vers, slot), workers: copyWorkers(cfg, opts.jobs)}
 
-	// Overwrite slot dir
-	_ = os.RemoveAll(dst)
-	if err := os.MkdirAll(dst, 0o755); err != nil {
-		return "", fmt.Errorf("create dest: %w", err)
-	}
-	if err := copyDirContents(srcAbs, dst); err != nil {
-		_ = os.RemoveAll(dst)
+	if err := runPreBackupHook(cfg, proj); err != nil {
 		return "", err
 	}
-	if err := writeMetaAtomic(dst, time.Now()); err != nil {
-		_ = os.RemoveAll(dst)
+	// Overwrite slot dir
+	if err := writeVersion(srcAbs, dst, backupRoot, cfg, copyOpts, opts.message); err != nil {
 		return "", err
 	}
+	uploadVersion(dst)
+	pruneAfterBackup(proj, cfg, protectedNums)
+	runPostBackupHook(cfg, proj, dst)
 
 	return dst, nil
 }
 
-func listProjectVersions(projectRoot, project string) ([]Version, error) {
-	ents, err := os.ReadDir(projectRoot)
+// uploadVersion copies a new version to the remote backend, if any. The local
+// backup has succeeded at this point, so a failed upload only warns.
+func uploadVersion(dst string) {
+	if err := pushVersion(dst); err != nil {
+		warnf("%s is saved locally but was not uploaded: %v", dst, err)
+	}
+}
+
+// pruneAfterBackup applies the retention policy once a new version exists.
+// The backup itself has succeeded at this point, so failures only warn.
+func pruneAfterBackup(p Project, cfg Config, protectedNums map[int]bool) {
+	removed, err := applyRetention(p.Root, p.Name, cfg, protectedNums)
+	for _, v := range removed {
+		fmt.Fprintf(os.Stderr, "bkup: retention removed %s\n", v.Path)
+	}
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
+		warnf("%v", err)
+	}
+}
+
+// writeVersion writes a version of srcAbs in the configured storage format
+// (sealed if encryption is on) into a temp dir next to dst: contents, manifest
+// and, last, meta. Only a complete version replaces dst (see slots.go); on
+// failure the temp dir is removed and dst is left as it was.
+func writeVersion(srcAbs, dst, backupRoot string, cfg Config, opts copyOptions, message string) error {
+	format := storedFormat(cfg)
+
+	dirMode := fs.FileMode(0o755)
+	if cfg.Encryption.enabled() {
+		key, err := unlockKey(backupRoot, cfg.Encryption, true)
+		if err != nil {
+			return err
+		}
+		opts.key = key
+		dirMode = 0o700
+	}
+
+	tmp, err := newTempSlot(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, dirMode); err != nil {
+		_ = os.RemoveAll(tmp)
+		return fmt.Errorf("create temp slot: %w", err)
+	}
+
+	manifest := &Manifest{}
+	opts.record = manifest
+	if opts.linkDest != "" {
+		opts.linkHashes = manifestHashes(opts.linkDest)
+	}
+
+	switch format {
+	case formatChunked:
+		err = storeChunkedTree(srcAbs, objectsDir(backupRoot), opts)
+	case formatTarGz, formatTarZst:
+		err = createArchive(srcAbs, archivePathForDir(tmp, format), format, opts)
+	default:
+		err = copyDirContents(srcAbs, tmp, opts)
+	}
+	if err == nil {
+		err = writeManifestAtomic(tmp, *manifest, opts.key)
+	}
+	if err == nil && opts.key != nil && format == formatChunked {
+		err = writeObjectList(tmp, *manifest)
+	}
+	if err == nil {
+		meta := newMeta(time.Now(), format, srcAbs)
+		meta.Message = message
+		meta.Encrypted = opts.key != nil
+		meta.Manifest = true
+		if opts.only != nil {
+			meta.Paths = opts.only.patterns
+		}
+		err = writeMetaAtomic(tmp, meta)
+	}
+	if err == nil {
+		err = commitSlot(tmp, dst)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+// linkDestFor returns the newest version to hard-link unchanged files from when
+// incremental mode is on, or "" otherwise. The slot about to be overwritten is
+// never used, since it is being replaced.
+func linkDestFor(cfg Config, vers []Version, slot int) string {
+	if !cfg.Incremental || storedFormat(cfg) != formatDir {
+		return ""
+	}
+	var best *Version
+	for i := range vers {
+		v := &vers[i]
+		if v.N == slot || v.Format != formatDir || v.Remote || v.partial() {
+			continue
+		}
+		if best == nil || v.CreatedUnix > best.CreatedUnix ||
+			(v.CreatedUnix == best.CreatedUnix && v.N > best.N) {
+			best = v
 		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Path
+}
+
+func listProjectVersions(projectRoot, project string) ([]Version, error) {
+	ents, err := os.ReadDir(projectRoot)
+	if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("read project root: %w", err)
 	}
 
 	prefix := project + "_"
 	out := make([]Version, 0, len(ents))
+	local := map[string]bool{}
 
 	for _, e := range ents {
 		if !e.IsDir() {
@@ -632,17 +978,34 @@ func listProjectVersions(projectRoot, project string) ([]Version, error) {
 		}
 
 		full := filepath.Join(projectRoot, name)
-		createdUnix, hasMeta, err := readCreatedUnix(full)
+		meta, hasMeta, err := readMeta(full)
 		if err != nil {
 			return nil, err
 		}
 
-		out = append(out, Version{
-			N:           n,
-			Path:        full,
-			CreatedUnix: createdUnix,
-			HasMeta:     hasMeta,
-		})
+		v := versionFromMeta(n, full, meta, false)
+		v.HasMeta = hasMeta
+		out = append(out, v)
+		// A slot without meta may be an interrupted download: a complete remote copy supersedes it.
+		local[name] = hasMeta
+	}
+
+	remote, err := remoteVersions(projectRoot, project, local)
+	if err != nil {
+		return nil, err
+	}
+	if len(remote) > 0 {
+		superseded := map[int]bool{}
+		for _, v := range remote {
+			superseded[v.N] = true
+		}
+		kept := out[:0]
+		for _, v := range out {
+			if !superseded[v.N] {
+				kept = append(kept, v)
+			}
+		}
+		out = append(kept, remote...)
 	}
 
 	// Default sort by N (nice for list). Newest/oldest use CreatedUnix separately.
@@ -650,15 +1013,39 @@ func listProjectVersions(projectRoot, project string) ([]Version, error) {
 	return out, nil
 }
 
-// newestBackupPath returns the path to the newest backup (by meta created_unix).
-// If none exist, returns "" with nil error.
-func newestBackupPath(projectRoot, project string) (string, error) {
-	vers, err := listProjectVersions(projectRoot, project)
+func versionFromMeta(n int, path string, meta Meta, remote bool) Version {
+	return Version{
+		N:           n,
+		Path:        path,
+		CreatedUnix: meta.CreatedUnix,
+		HasMeta:     meta.CreatedUnix > 0,
+		Format:      normalizeFormat(meta.Format),
+		SourcePath:  meta.SourcePath,
+		Message:     meta.Message,
+		Pinned:      meta.Pinned,
+		Tags:        meta.Tags,
+		Encrypted:   meta.Encrypted,
+		HasManifest: meta.Manifest,
+		Paths:       meta.Paths,
+		Remote:      remote,
+	}
+}
+
+// newestVersion returns the newest full backup (by meta created_unix); partial
+// versions are skipped. If none exist, returns ok=false with nil error.
+func newestVersion(projectRoot, project string) (Version, bool, error) {
+	all, err := listProjectVersions(projectRoot, project)
 	if err != nil {
-		return "", err
+		return Version{}, false, err
+	}
+	vers := all[:0]
+	for _, v := range all {
+		if !v.partial() {
+			vers = append(vers, v)
+		}
 	}
 	if len(vers) == 0 {
-		return "", nil
+		return Version{}, false, nil
 	}
 	sort.Slice(vers, func(i, j int) bool {
 		// Newest first; tie-breaker: higher N.
@@ -667,25 +1054,68 @@ func newestBackupPath(projectRoot, project string) (string, error) {
 		}
 		return vers[i].CreatedUnix > vers[j].CreatedUnix
 	})
-	return vers[0].Path, nil
+	return vers[0], true, nil
+}
+
+// formatVersionLine renders one `bkup list` row: number, creation time, path, pin, tags, message.
+func formatVersionLine(v Version) string {
+	created := time.Unix(v.CreatedUnix, 0).Local().Format("2006-01-02 15:04:05")
+	line := fmt.Sprintf("%3d  %s  %s", v.N, created, v.Path)
+	if v.Pinned {
+		line += "  [pinned]"
+	}
+	if v.Remote {
+		line += "  [remote]"
+	}
+	if v.partial() {
+		line += "  [partial: " + strings.Join(v.Paths, ", ") + "]"
+	}
+	for _, t := range v.Tags {
+		line += "  #" + t
+	}
+	if v.Message != "" {
+		line += "  " + v.Message
+	}
+	return line
 }
 
-// cleanseBackupRoot deletes everything directly under backupRoot except cfgPath.
-// It returns number removed.
-func cleanseBackupRoot(backupRoot, cfgPath string) (int, error) {
+// findVersion returns backup number n of a project.
+func findVersion(projectRoot, project string, n int) (Version, error) {
+	vers, err := listProjectVersions(projectRoot, project)
+	if err != nil {
+		return Version{}, err
+	}
+	for _, v := range vers {
+		if v.N == n {
+			return v, nil
+		}
+	}
+	return Version{}, fmt.Errorf("backup not found: %s", filepath.Join(projectRoot, fmt.Sprintf("%s_%d", project, n)))
+}
+
+// cleanseBackupRoot deletes everything directly under backupRoot except the
+// keep paths (config and state, if they are there), the keyring and the lock
+// files, and everything but the keyring on the remote backend. It holds every
+// lock while doing so. It returns number removed locally.
+func cleanseBackupRoot(backupRoot string, keep ...string) (int, error) {
+	release, err := lockEverything(backupRoot)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
 	entries, err := os.ReadDir(backupRoot)
 	if err != nil {
 		return 0, fmt.Errorf("read backup root: %w", err)
 	}
 
-	cfgBase := filepath.Base(cfgPath)
 	removed := 0
 
 	for _, e := range entries {
 		name := e.Name()
 		full := filepath.Join(backupRoot, name)
 
-		if name == cfgBase {
+		if slices.Contains(keep, full) || name == keyringFileName || name == lockDirName {
 			continue
 		}
 		if err := os.RemoveAll(full); err != nil {
@@ -694,12 +1124,28 @@ func cleanseBackupRoot(backupRoot, cfgPath string) (int, error) {
 		removed++
 	}
 
+	if err := cleanseRemote(backupRoot); err != nil {
+		return removed, fmt.Errorf("cleanse remote: %w", err)
+	}
 	return removed, nil
 }
 
 // -------------------- COPY + REPLACE IMPLEMENTATION --------------------
 
-func copyDirContents(srcDir, dstDir string) error {
+type copyOptions struct {
+	ignore     *ignoreMatcher    // skip matching paths; ignored directories are not walked
+	only       *pathSelector     // copy just these paths (nil = everything)
+	linkDest   string            // hard-link unchanged files from this tree instead of copying
+	linkHashes map[string]string // sha256 by path from linkDest's manifest (saves re-hashing links)
+	record     *Manifest         // if set, every copied entry is recorded here with its sha256
+	key        *sealKey          // seal archives and chunks with this key (nil = plaintext)
+	workers    int               // parallel file copies (< 1 means 1)
+}
+
+// walkSource walks srcDir and calls fn for every entry opts selects (never for
+// srcDir itself or bkup's own files at its root). Ignored directories, and
+// directories that cannot contain a selected path, are not walked at all.
+func walkSource(srcDir string, opts copyOptions, fn func(path, rel string, d fs.DirEntry) error) error {
 	return filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
@@ -712,13 +1158,54 @@ func copyDirContents(srcDir, dstDir string) error {
 		if rel == "." {
 			return nil
 		}
+		if isInternalFile(rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if opts.ignore.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if opts.only != nil && !opts.only.Match(rel) {
+			if d.IsDir() && !opts.only.MayContain(rel) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		return fn(path, rel, d)
+	})
+}
 
+// copyDirContents copies everything under srcDir into dstDir according to opts,
+// with opts.workers files in flight at once (see copypool.go). Directories are
+// created as the walk reaches them; their modes and mtimes are applied at the
+// end, once nothing is written into them anymore.
+func copyDirContents(srcDir, dstDir string, opts copyOptions) error {
+	type dirMeta struct {
+		path string
+		info fs.FileInfo
+	}
+	var (
+		dirs    []dirMeta
+		entries []*ManifestEntry // walk order, filled in by the workers
+		pool    = newCopyPool(opts.workers, opts)
+	)
+	walkErr := walkSource(srcDir, opts, func(path, rel string, d fs.DirEntry) error {
+		if err := pool.failed(); err != nil {
+			return err
+		}
 		dstPath := filepath.Join(dstDir, rel)
 
 		info, err := d.Info()
 		if err != nil {
 			return err
 		}
+		e := newManifestEntry(rel, info)
+		entries = append(entries, &e)
 
 		// Handle symlinks.
 		if d.Type()&os.ModeSymlink != 0 {
@@ -730,30 +1217,66 @@ func copyDirContents(srcDir, dstDir string) error {
 				return err
 			}
 			_ = os.RemoveAll(dstPath)
-			return os.Symlink(target, dstPath)
+			if err := os.Symlink(target, dstPath); err != nil {
+				return err
+			}
+			e.Link = target
+			return nil
 		}
 
 		if d.IsDir() {
-			if err := os.MkdirAll(dstPath, info.Mode().Perm()); err != nil {
+			// Owner-writable until the end, whatever its final mode.
+			if err := os.MkdirAll(dstPath, 0o700); err != nil {
 				return err
 			}
-			_ = os.Chtimes(dstPath, time.Now(), info.ModTime())
+			dirs = append(dirs, dirMeta{dstPath, info})
 			return nil
 		}
 
-		// Regular file → copy bytes.
+		// Regular file → queued for a worker (hard-link if unchanged since linkDest, else copy bytes).
 		if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
 			return err
 		}
-		if err := copyFile(path, dstPath, info.Mode()); err != nil {
+		return pool.submit(copyJob{src: path, dst: dstPath, rel: rel, info: info, entry: &e})
+	})
+	if err := pool.wait(); err != nil {
+		return err
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+
+	// Deepest first, so setting a parent's mtime is the last change inside it.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].info.Mode().Perm()); err != nil {
 			return err
 		}
-		_ = os.Chtimes(dstPath, time.Now(), info.ModTime())
-		return nil
-	})
+		_ = os.Chtimes(dirs[i].path, time.Now(), dirs[i].info.ModTime())
+	}
+	for _, e := range entries {
+		opts.record.add(*e)
+	}
+	return nil
+}
+
+// linkUnchanged hard-links prev to dst if prev is a regular file with the same
+// size, mtime and permissions as info. It reports whether a link was made;
+// any failure (missing file, cross-device, unsupported FS) means "copy instead".
+func linkUnchanged(prev, dst string, info fs.FileInfo) bool {
+	pi, err := os.Lstat(prev)
+	if err != nil || !pi.Mode().IsRegular() || !info.Mode().IsRegular() {
+		return false
+	}
+	if pi.Size() != info.Size() || !pi.ModTime().Equal(info.ModTime()) || pi.Mode().Perm() != info.Mode().Perm() {
+		return false
+	}
+	_ = os.RemoveAll(dst)
+	return os.Link(prev, dst) == nil
 }
 
-func copyFile(src, dst string, mode fs.FileMode) error {
+// copyFile copies src to dst with the given permissions, feeding the bytes
+// through h as well when h is non-nil.
+func copyFile(src, dst string, mode fs.FileMode, h hash.Hash) error {
 	in, err := os.Open(src)
 	if err != nil {
 		return err
@@ -767,60 +1290,48 @@ func copyFile(src, dst string, mode fs.FileMode) error {
 	}
 	defer func() { _ = out.Close() }()
 
-	if _, err := io.Copy(out, in); err != nil {
+	var w io.Writer = out
+	if h != nil {
+		w = io.MultiWriter(out, h)
+	}
+	if _, err := io.Copy(w, in); err != nil {
 		return err
 	}
 	return out.Close()
 }
 
-// replaceDirContents replaces the contents of dstDir with the contents of srcDir,
-// leaving dstDir itself in place. It stages the source into a temp dir first, then
-// clears dstDir, then copies staged contents into dstDir.
-func replaceDirContents(dstDir, srcDir string) error {
-	dstDir = mustAbs(dstDir)
-	srcDir = mustAbs(srcDir)
-
-	if fi, err := os.Stat(dstDir); err != nil || !fi.IsDir() {
-		return fmt.Errorf("destination is not a directory: %s", dstDir)
-	}
-	if fi, err := os.Stat(srcDir); err != nil || !fi.IsDir() {
-		return fmt.Errorf("source is not a directory: %s", srcDir)
-	}
-
-	parent := filepath.Dir(dstDir)
-	stage, err := os.MkdirTemp(parent, ".bkup-stage-*")
+// removeUnignored removes the non-ignored entries below root/rel and reports
+// whether anything had to be kept.
+func removeUnignored(root, rel string, ign *ignoreMatcher) (bool, error) {
+	entries, err := os.ReadDir(filepath.Join(root, rel))
 	if err != nil {
-		return fmt.Errorf("create staging dir: %w", err)
-	}
-	defer os.RemoveAll(stage)
-
-	if err := copyDirContents(srcDir, stage); err != nil {
-		return fmt.Errorf("stage copy: %w", err)
-	}
-
-	if err := removeDirContents(dstDir); err != nil {
-		return fmt.Errorf("clear destination: %w", err)
-	}
-
-	if err := copyDirContents(stage, dstDir); err != nil {
-		return fmt.Errorf("restore staged into destination: %w", err)
-	}
-
-	return nil
-}
-
-func removeDirContents(dir string) error {
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return err
+		return false, err
 	}
+	kept := false
 	for _, e := range entries {
-		full := filepath.Join(dir, e.Name())
+		childRel := filepath.Join(rel, e.Name())
+		full := filepath.Join(root, childRel)
+		isDir := e.IsDir()
+
+		if ign.Match(childRel, isDir) {
+			kept = true
+			continue
+		}
+		if isDir && ign != nil {
+			childKept, err := removeUnignored(root, childRel, ign)
+			if err != nil {
+				return kept, err
+			}
+			if childKept {
+				kept = true
+				continue
+			}
+		}
 		if err := os.RemoveAll(full); err != nil {
-			return err
+			return kept, err
 		}
 	}
-	return nil
+	return kept, nil
 }
 
 // -------------------- SHELL + EDITOR --------------------
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const manifestFileName = ".bkup_manifest.json"
+
+// -------------------- MANIFEST --------------------
+
+// Manifest describes a stored tree: one entry per file, dir and symlink,
+// in walk order (parents before children). Every version gets one, written
+// next to .bkup_meta.json; `bkup verify` checks the stored data against it.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+type ManifestEntry struct {
+	Path    string   `json:"path"` // slash-separated, relative to the project root
+	Type    string   `json:"type"` // "file", "dir" or "symlink"
+	Mode    uint32   `json:"mode"` // permission bits
+	Size    int64    `json:"size,omitempty"`
+	MTimeNs int64    `json:"mtime_ns"`
+	Link    string   `json:"link,omitempty"`   // symlink target
+	SHA256  string   `json:"sha256,omitempty"` // file contents
+	Chunks  []string `json:"chunks,omitempty"` // object ids, in order (chunked format only)
+}
+
+const (
+	entryFile    = "file"
+	entryDir     = "dir"
+	entrySymlink = "symlink"
+)
+
+func manifestPathForDir(backupDir string) string {
+	return filepath.Join(backupDir, manifestFileName)
+}
+
+// writeManifestAtomic writes m to backupDir, sealed when key is non-nil.
+func writeManifestAtomic(backupDir string, m Manifest, key *sealKey) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	if key != nil {
+		b = key.sealBlob(b)
+	}
+	p := manifestPathForDir(backupDir)
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("write manifest temp: %w", err)
+	}
+	return os.Rename(tmp, p)
+}
+
+// readManifest reads backupDir's manifest; sealed manifests need key.
+func readManifest(backupDir string, key *sealKey) (Manifest, error) {
+	p := manifestPathForDir(backupDir)
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("read manifest: %w", err)
+	}
+	return parseManifest(b, key, p)
+}
+
+// parseManifest decodes manifest bytes read from p (used in messages).
+func parseManifest(b []byte, key *sealKey, p string) (Manifest, error) {
+	var err error
+	if isSealedBlob(b) {
+		if key == nil {
+			return Manifest{}, fmt.Errorf("%s: %w", p, errSealed)
+		}
+		if b, err = key.openBlob(b); err != nil {
+			return Manifest{}, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Manifest{}, fmt.Errorf("parse manifest %s: %w", p, err)
+	}
+	return m, nil
+}
+
+// newManifestEntry describes rel from info. Content fields (SHA256, Chunks)
+// and the symlink target are left to the caller.
+func newManifestEntry(rel string, info fs.FileInfo) ManifestEntry {
+	e := ManifestEntry{
+		Path:    filepath.ToSlash(rel),
+		Mode:    uint32(info.Mode().Perm()),
+		MTimeNs: info.ModTime().UnixNano(),
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		e.Type = entrySymlink
+	case info.IsDir():
+		e.Type = entryDir
+	default:
+		e.Type = entryFile
+		e.Size = info.Size()
+	}
+	return e
+}
+
+// add appends e; a nil manifest records nothing.
+func (m *Manifest) add(e ManifestEntry) {
+	if m != nil {
+		m.Entries = append(m.Entries, e)
+	}
+}
+
+// manifestHashes returns path -> sha256 for the files in backupDir's manifest,
+// or nil if it has none (e.g. a version created before manifests existed).
+func manifestHashes(backupDir string) map[string]string {
+	m, err := readManifest(backupDir, nil)
+	if err != nil {
+		return nil
+	}
+	out := make(map[string]string, len(m.Entries))
+	for _, e := range m.Entries {
+		if e.SHA256 != "" {
+			out[e.Path] = e.SHA256
+		}
+	}
+	return out
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hexSum(h), nil
+}
+
+// -------------------- VERIFY --------------------
+
+type verifyResult struct {
+	Version    Version
+	Files      int
+	Missing    []string
+	Extra      []string
+	Corrupted  []string // "path: reason"
+	NoManifest bool
+}
+
+func (r verifyResult) ok() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Corrupted) == 0
+}
+
+// expectsManifest reports whether v was written with a manifest: its meta says
+// so, or it could not exist without one (chunked and encrypted versions).
+// Only older dir and archive versions may lack one.
+func (v Version) expectsManifest() bool {
+	return v.HasManifest || v.Format == formatChunked || v.Encrypted
+}
+
+// verifyVersion re-reads everything stored for v and compares it with its manifest.
+func verifyVersion(backupRoot string, cfg Config, v Version) (verifyResult, error) {
+	res := verifyResult{Version: v}
+	if err := fetchVersion(v.Path); err != nil {
+		return res, err
+	}
+	if _, err := os.Stat(manifestPathForDir(v.Path)); os.IsNotExist(err) {
+		if v.expectsManifest() {
+			// Deleting the manifest must not hide tampering.
+			res.Missing = append(res.Missing, manifestFileName)
+		} else {
+			res.NoManifest = true
+		}
+		return res, nil
+	}
+	key, err := versionKey(backupRoot, cfg, v)
+	if err != nil {
+		return res, err
+	}
+	m, err := readManifest(v.Path, key)
+	if err != nil {
+		return res, err
+	}
+
+	expected := make(map[string]ManifestEntry, len(m.Entries))
+	for _, e := range m.Entries {
+		expected[e.Path] = e
+		if e.Type == entryFile {
+			res.Files++
+		}
+	}
+	seen := map[string]bool{}
+
+	switch v.Format {
+	case formatDir:
+		err = walkSource(v.Path, copyOptions{}, func(path, rel string, d fs.DirEntry) error {
+			rel = filepath.ToSlash(rel)
+			e, ok := expected[rel]
+			if !ok {
+				res.Extra = append(res.Extra, rel)
+				return nil
+			}
+			seen[rel] = true
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if reason := checkStoredEntry(e, newManifestEntry(rel, info), path); reason != "" {
+				res.Corrupted = append(res.Corrupted, rel+": "+reason)
+			}
+			return nil
+		})
+	case formatChunked:
+		objDir := objectsDir(backupRoot)
+		for _, e := range m.Entries {
+			seen[e.Path] = true
+			if e.Type != entryFile {
+				continue
+			}
+			if reason := checkChunkedFile(objDir, e, key); reason != "" {
+				res.Corrupted = append(res.Corrupted, e.Path+": "+reason)
+			}
+		}
+	case formatTarGz, formatTarZst:
+		err = verifyArchive(archivePathForDir(v.Path, v.Format), v.Format, key, expected, seen, &res)
+	default:
+		return res, fmt.Errorf("%s: unknown format %q", v.Path, v.Format)
+	}
+	if err != nil {
+		return res, err
+	}
+
+	for _, e := range m.Entries {
+		if !seen[e.Path] {
+			res.Missing = append(res.Missing, e.Path)
+		}
+	}
+	return res, nil
+}
+
+// checkStoredEntry compares a stored entry on disk (got, at path) with the
+// manifest (want). Returns "" if it matches.
+func checkStoredEntry(want, got ManifestEntry, path string) string {
+	if want.Type != got.Type {
+		return fmt.Sprintf("is a %s, expected a %s", got.Type, want.Type)
+	}
+	switch want.Type {
+	case entrySymlink:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err.Error()
+		}
+		if target != want.Link {
+			return fmt.Sprintf("symlink points to %q, expected %q", target, want.Link)
+		}
+	case entryFile:
+		if got.Size != want.Size {
+			return fmt.Sprintf("size %d, expected %d", got.Size, want.Size)
+		}
+		sum, err := sha256File(path)
+		if err != nil {
+			return err.Error()
+		}
+		if want.SHA256 != "" && sum != want.SHA256 {
+			return "sha256 mismatch"
+		}
+	}
+	return ""
+}
+
+func checkChunkedFile(objDir string, e ManifestEntry, key *sealKey) string {
+	h := sha256.New()
+	var size int64
+	for _, id := range e.Chunks {
+		data, err := os.ReadFile(objectPath(objDir, id))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "missing chunk " + id
+			}
+			return err.Error()
+		}
+		if key != nil {
+			if data, err = key.openBlob(data); err != nil {
+				return "corrupted chunk " + id
+			}
+		}
+		if key.objectID(data) != id {
+			return "corrupted chunk " + id
+		}
+		h.Write(data)
+		size += int64(len(data))
+	}
+	if size != e.Size {
+		return fmt.Sprintf("size %d, expected %d", size, e.Size)
+	}
+	if e.SHA256 != "" && hexSum(h) != e.SHA256 {
+		return "sha256 mismatch"
+	}
+	return ""
+}
+
+func verifyArchive(src, format string, key *sealKey, expected map[string]ManifestEntry, seen map[string]bool, res *verifyResult) error {
+	f, err := os.Open(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			res.Corrupted = append(res.Corrupted, filepath.Base(src)+": archive is missing")
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r, err := openArchiveStream(f, key)
+	if err != nil {
+		res.Corrupted = append(res.Corrupted, filepath.Base(src)+": "+err.Error())
+		return nil
+	}
+	zr, err := newDecompressor(r, format)
+	if err != nil {
+		res.Corrupted = append(res.Corrupted, filepath.Base(src)+": "+err.Error())
+		return nil
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			res.Corrupted = append(res.Corrupted, filepath.Base(src)+": "+err.Error())
+			return nil
+		}
+		rel := strings.TrimSuffix(hdr.Name, "/")
+		e, ok := expected[rel]
+		if !ok {
+			res.Extra = append(res.Extra, rel)
+			continue
+		}
+		seen[rel] = true
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			if e.Type != entryFile {
+				res.Corrupted = append(res.Corrupted, fmt.Sprintf("%s: is a file, expected a %s", rel, e.Type))
+				continue
+			}
+			h := sha256.New()
+			n, err := io.Copy(h, tr)
+			if err != nil {
+				res.Corrupted = append(res.Corrupted, rel+": "+err.Error())
+				return nil
+			}
+			if n != e.Size {
+				res.Corrupted = append(res.Corrupted, fmt.Sprintf("%s: size %d, expected %d", rel, n, e.Size))
+			} else if e.SHA256 != "" && hexSum(h) != e.SHA256 {
+				res.Corrupted = append(res.Corrupted, rel+": sha256 mismatch")
+			}
+		case tar.TypeSymlink:
+			if e.Type != entrySymlink || hdr.Linkname != e.Link {
+				res.Corrupted = append(res.Corrupted, fmt.Sprintf("%s: symlink points to %q, expected %q", rel, hdr.Linkname, e.Link))
+			}
+		case tar.TypeDir:
+			if e.Type != entryDir {
+				res.Corrupted = append(res.Corrupted, fmt.Sprintf("%s: is a dir, expected a %s", rel, e.Type))
+			}
+		}
+	}
+}
+
+// printVerifyResult prints one verify report.
+func printVerifyResult(w io.Writer, r verifyResult) {
+	name := filepath.Base(r.Version.Path)
+	switch {
+	case r.NoManifest:
+		fmt.Fprintf(w, "UNVERIFIED  %s  (no manifest; created before integrity manifests existed)\n", name)
+		return
+	case r.ok():
+		fmt.Fprintf(w, "OK          %s  (%d file(s))\n", name, r.Files)
+		return
+	}
+	fmt.Fprintf(w, "FAILED      %s  (%d missing, %d extra, %d corrupted)\n", name, len(r.Missing), len(r.Extra), len(r.Corrupted))
+	for _, p := range r.Missing {
+		fmt.Fprintf(w, "  missing:   %s\n", p)
+	}
+	for _, p := range r.Extra {
+		fmt.Fprintf(w, "  extra:     %s\n", p)
+	}
+	for _, p := range r.Corrupted {
+		fmt.Fprintf(w, "  corrupted: %s\n", p)
+	}
+}
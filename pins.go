@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// -------------------- PINS + TAGS --------------------
+//
+// Pins and tags live in each version's .bkup_meta.json. Pinned and tagged
+// versions are never evicted by -q (FIFO) overwrites, retention or prune; they
+// still occupy a slot, so at most max_pinned of them are allowed (never more
+// than max_versions-1, which keeps one slot free for FIFO to rotate through).
+// Tags are names that can be used wherever a backup number is accepted.
+
+// exempt reports whether v is pinned or tagged, i.e. never deleted or
+// overwritten to make room.
+func (v Version) exempt() bool { return v.Pinned || len(v.Tags) > 0 }
+
+// resolveVersionRef finds a backup by number or tag name.
+func resolveVersionRef(projectRoot, project, ref string) (Version, error) {
+	if n, err := strconv.Atoi(ref); err == nil {
+		if n < 0 {
+			return Version{}, fmt.Errorf("invalid backup number: %q", ref)
+		}
+		return findVersion(projectRoot, project, n)
+	}
+
+	vers, err := listProjectVersions(projectRoot, project)
+	if err != nil {
+		return Version{}, err
+	}
+	for _, v := range vers {
+		for _, t := range v.Tags {
+			if t == ref {
+				return v, nil
+			}
+		}
+	}
+	return Version{}, fmt.Errorf("no backup number or tag %q for project %q", ref, project)
+}
+
+// effectiveMaxPinned returns how many versions may be pinned at once, or -1
+// for no limit (unlimited max_versions without a max_pinned).
+func effectiveMaxPinned(cfg Config) int {
+	limit := cfg.MaxPinned
+	if limit <= 0 {
+		limit = -1
+	}
+	if cfg.MaxVersions > 0 && (limit < 0 || limit > cfg.MaxVersions-1) {
+		limit = cfg.MaxVersions - 1
+	}
+	return limit
+}
+
+// checkMaxPinned refuses to make one more version of vers exempt once
+// max_pinned of them are pinned or tagged.
+func checkMaxPinned(vers []Version, cfg Config) error {
+	count := 0
+	for _, o := range vers {
+		if o.exempt() {
+			count++
+		}
+	}
+	if limit := effectiveMaxPinned(cfg); limit >= 0 && count >= limit {
+		return fmt.Errorf("max_pinned reached (%d pinned or tagged of %d allowed); unpin or untag a backup first or raise max_pinned/max_versions", count, limit)
+	}
+	return nil
+}
+
+// pinVersion pins or unpins v, enforcing max_pinned when pinning.
+func pinVersion(projectRoot, project string, cfg Config, v Version, pinned bool) error {
+	if pinned && !v.exempt() {
+		vers, err := listProjectVersions(projectRoot, project)
+		if err != nil {
+			return err
+		}
+		if err := checkMaxPinned(vers, cfg); err != nil {
+			return err
+		}
+	}
+	return updateMeta(v.Path, func(m *Meta) { m.Pinned = pinned })
+}
+
+// tagVersion adds name to v's tags. Tag names are unique per project, and a
+// first tag counts against max_pinned like a pin.
+func tagVersion(projectRoot, project string, cfg Config, v Version, name string) error {
+	if err := validateTagName(name); err != nil {
+		return err
+	}
+	vers, err := listProjectVersions(projectRoot, project)
+	if err != nil {
+		return err
+	}
+	for _, o := range vers {
+		for _, t := range o.Tags {
+			if t == name && o.N != v.N {
+				return fmt.Errorf("tag %q is already on %s (run `bkup untag %s` first)", name, o.Path, name)
+			}
+		}
+	}
+	if !v.exempt() {
+		if err := checkMaxPinned(vers, cfg); err != nil {
+			return err
+		}
+	}
+	return updateMeta(v.Path, func(m *Meta) {
+		for _, t := range m.Tags {
+			if t == name {
+				return
+			}
+		}
+		m.Tags = append(m.Tags, name)
+	})
+}
+
+// untagVersion removes name from whichever version carries it.
+func untagVersion(projectRoot, project, name string) (Version, error) {
+	v, err := resolveVersionRef(projectRoot, project, name)
+	if err != nil {
+		return Version{}, err
+	}
+	err = updateMeta(v.Path, func(m *Meta) {
+		kept := m.Tags[:0]
+		for _, t := range m.Tags {
+			if t != name {
+				kept = append(kept, t)
+			}
+		}
+		m.Tags = kept
+	})
+	return v, err
+}
+
+func validateTagName(name string) error {
+	if name == "" {
+		return fmt.Errorf("tag name is empty")
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		return fmt.Errorf("tag %q looks like a backup number; pick a name with letters", name)
+	}
+	if strings.ContainsAny(name, " \t\n,/\\") || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("invalid tag %q: no spaces, commas, slashes or leading dashes", name)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// processAlive reports whether a process with this pid exists on this machine.
+// On Windows, FindProcess opens the process and fails if there is none.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const projectFileName = ".bkup_project.json"
+
+// -------------------- PROJECT IDENTITY --------------------
+//
+// A project is identified by the absolute path of its source directory, not by
+// its basename. Each <...>_backup dir records its source in .bkup_project.json:
+//   - the first directory named "api" gets <backupRoot>/api_backup
+//   - any other "api" (different absolute path) gets api-<hash>_backup
+//   - a legacy api_backup without a project file is adopted by the first
+//     source that uses it (its versions predate recorded source paths)
+//   - "name" in the project config (projectconfig.go) replaces the basename
+//
+// Slots keep their readable names (api_0, api_1, ...) in every case.
+
+type Project struct {
+	Name   string // readable name (source dir basename), used for slot names and display
+	Source string // absolute source path
+	Root   string // <backupRoot>/<...>_backup
+}
+
+type projectFile struct {
+	Name       string `json:"name"`
+	SourcePath string `json:"source_path"`
+}
+
+// resolveProject finds the backup dir for srcAbs. It does not create anything
+// except when adopting a legacy dir; use ensureProjectRoot before writing.
+func resolveProject(backupRoot, srcAbs string) (Project, error) {
+	srcAbs = mustAbs(srcAbs)
+	name, err := projectName(srcAbs)
+	if err != nil {
+		return Project{}, err
+	}
+	p := Project{Name: name, Source: srcAbs}
+
+	hashed := filepath.Join(backupRoot, name+"-"+sourceHash(srcAbs)+"_backup")
+	plain := filepath.Join(backupRoot, name+"_backup")
+	// With a remote backend, a fresh machine learns which dir is whose.
+	for _, dir := range []string{hashed, plain} {
+		if err := fetchFile(backupRoot, filepath.Join(dir, projectFileName)); err != nil {
+			return Project{}, fmt.Errorf("fetch project file: %w", err)
+		}
+	}
+	if _, err := os.Stat(hashed); err == nil {
+		p.Root = hashed
+		return p, nil
+	}
+
+	if _, err := os.Stat(plain); os.IsNotExist(err) {
+		p.Root = plain
+		return p, nil
+	}
+
+	pf, ok, err := readProjectFile(plain)
+	if err != nil {
+		return Project{}, err
+	}
+	switch {
+	case ok && pf.SourcePath == srcAbs:
+		p.Root = plain
+	case ok:
+		// Same basename, different source: never share.
+		p.Root = hashed
+	default:
+		// Legacy dir from before source paths were recorded: adopt it.
+		p.Root = plain
+		if p.Root, err = adoptLegacyRoot(backupRoot, p, hashed); err != nil {
+			return Project{}, err
+		}
+	}
+	return p, nil
+}
+
+// adoptLegacyRoot records p.Source in the legacy backup dir p.Root, under the
+// project lock so concurrent commands don't both write it. If another bkup got
+// there first and recorded a different source, p gets its own dir, hashed.
+func adoptLegacyRoot(backupRoot string, p Project, hashed string) (string, error) {
+	lock, err := lockProject(backupRoot, p)
+	if err != nil {
+		return "", err
+	}
+	defer lock.release()
+
+	pf, ok, err := readProjectFile(p.Root)
+	switch {
+	case err != nil:
+		return "", err
+	case ok && pf.SourcePath == p.Source:
+		return p.Root, nil
+	case ok:
+		return hashed, nil
+	}
+	if err := writeProjectFile(p.Root, projectFile{Name: p.Name, SourcePath: p.Source}); err != nil {
+		return "", err
+	}
+	warnf("adopted existing backups in %s for %s (they were created before source paths were recorded; "+
+		"if they belong to another %q directory, move that directory's backups aside)", p.Root, p.Source, p.Name)
+	return p.Root, nil
+}
+
+// resolveProjectArg turns --project into a source directory: an existing
+// directory is used as is; anything else names a project in backupRoot, by
+// its name ("api") or backup dir ("api-1a2b3c4d_backup"), whose recorded
+// source path is used (it does not have to exist anymore).
+func resolveProjectArg(backupRoot, arg string) (string, error) {
+	if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+		return mustAbs(arg), nil
+	}
+	ents, err := os.ReadDir(backupRoot)
+	if err != nil {
+		return "", fmt.Errorf("read backup root: %w", err)
+	}
+	var sources []string
+	for _, e := range ents {
+		dir := e.Name()
+		if !e.IsDir() || !strings.HasSuffix(dir, "_backup") {
+			continue
+		}
+		pf, ok, err := readProjectFile(filepath.Join(backupRoot, dir))
+		if err != nil {
+			return "", err
+		}
+		if dir != arg && dir != arg+"_backup" && !(ok && pf.Name == arg) {
+			continue
+		}
+		if !ok || pf.SourcePath == "" {
+			return "", fmt.Errorf("%s records no source path; use --project with the project's directory", filepath.Join(backupRoot, dir))
+		}
+		sources = append(sources, pf.SourcePath)
+	}
+	switch len(sources) {
+	case 0:
+		return "", fmt.Errorf("--project %s: no such directory, and no project of that name in %s", arg, backupRoot)
+	case 1:
+		return sources[0], nil
+	}
+	return "", fmt.Errorf("--project %s is ambiguous (%s); use the directory or the backup dir name instead",
+		arg, strings.Join(sources, ", "))
+}
+
+// ensureProjectRoot creates p.Root and records its source path.
+func ensureProjectRoot(p Project) error {
+	if err := os.MkdirAll(p.Root, 0o755); err != nil {
+		return fmt.Errorf("create project root: %w", err)
+	}
+	if _, ok, err := readProjectFile(p.Root); err != nil || ok {
+		return err
+	}
+	return writeProjectFile(p.Root, projectFile{Name: p.Name, SourcePath: p.Source})
+}
+
+func sourceHash(srcAbs string) string {
+	sum := sha256.Sum256([]byte(srcAbs))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+func readProjectFile(projectRoot string) (projectFile, bool, error) {
+	path := filepath.Join(projectRoot, projectFileName)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return projectFile{}, false, nil
+		}
+		return projectFile{}, false, fmt.Errorf("read %s: %w", path, err)
+	}
+	var pf projectFile
+	if err := json.Unmarshal(b, &pf); err != nil {
+		return projectFile{}, false, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return pf, true, nil
+}
+
+func writeProjectFile(projectRoot string, pf projectFile) error {
+	b, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal project file: %w", err)
+	}
+	b = append(b, '\n')
+
+	path := filepath.Join(projectRoot, projectFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("write project file temp: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// warnForeignVersion warns if v records a source path other than p's.
+func warnForeignVersion(p Project, v Version) {
+	if v.SourcePath != "" && v.SourcePath != p.Source {
+		warnf("%s was backed up from %s, not %s", v.Path, v.SourcePath, p.Source)
+	}
+}
+
+func warnf(format string, a ...any) {
+	fmt.Fprintf(os.Stderr, "bkup warning: "+format+"\n", a...)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// -------------------- PROJECT CONFIG --------------------
+//
+// A project may carry its own settings in .bkup.json or .bkup.toml (not both)
+// in its source directory. They are merged over config.json for every command
+// run on that project:
+//   - name, max_versions, format: replace the global value
+//   - queue: makes -q the default (-q=false turns it off for one run)
+//   - ignore: appended to the global patterns (.bkupignore still comes last)
+//   - hooks: pre_backup and post_backup replace the global ones one by one
+//
+// name changes the project's backup dir and slot names (<name>_backup,
+// <name>_N); existing backups under the old name are not renamed.
+//
+// Example .bkup.toml:
+//   max_versions = 3
+//   queue = true
+//   ignore = ["data/", "*.parquet"]
+//   [hooks]
+//   pre_backup = "make clean"
+
+const (
+	projectConfigJSON = ".bkup.json"
+	projectConfigTOML = ".bkup.toml"
+)
+
+type ProjectConfig struct {
+	Name        string       `json:"name,omitempty" toml:"name"`
+	MaxVersions *int         `json:"max_versions,omitempty" toml:"max_versions"`
+	Queue       *bool        `json:"queue,omitempty" toml:"queue"`
+	Ignore      []string     `json:"ignore,omitempty" toml:"ignore"`
+	Format      string       `json:"format,omitempty" toml:"format"`
+	Hooks       *HooksConfig `json:"hooks,omitempty" toml:"hooks"`
+
+	path string // the file it was read from
+}
+
+// loadProjectConfig reads the project config in srcDir. It returns nil if
+// there is none.
+func loadProjectConfig(srcDir string) (*ProjectConfig, error) {
+	var found []string
+	for _, name := range []string{projectConfigJSON, projectConfigTOML} {
+		p := filepath.Join(srcDir, name)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+			found = append(found, p)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil
+	case 2:
+		return nil, fmt.Errorf("%s has both %s and %s; keep one", srcDir, projectConfigJSON, projectConfigTOML)
+	}
+	path := found[0]
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read project config: %w", err)
+	}
+
+	pc := &ProjectConfig{path: path}
+	if filepath.Base(path) == projectConfigJSON {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(pc); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	} else {
+		md, err := toml.Decode(string(b), pc)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if keys := md.Undecoded(); len(keys) > 0 {
+			return nil, fmt.Errorf("parse %s: unknown key %q", path, keys[0].String())
+		}
+	}
+	if err := pc.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pc, nil
+}
+
+func (pc *ProjectConfig) validate() error {
+	if n := pc.Name; n != "" {
+		if n == "." || n == ".." || strings.ContainsAny(n, `/\`) || strings.HasSuffix(n, "_backup") {
+			return fmt.Errorf("name %q must be a plain directory name (no slashes, not ending in _backup)", n)
+		}
+	}
+	if pc.MaxVersions != nil && *pc.MaxVersions == 0 {
+		return errors.New("max_versions must be -1 (unlimited) or at least 1")
+	}
+	return validateFormat(pc.Format)
+}
+
+// apply returns cfg with pc merged over it (see above).
+func (pc *ProjectConfig) apply(cfg Config) Config {
+	if pc == nil {
+		return cfg
+	}
+	if pc.MaxVersions != nil {
+		cfg.MaxVersions = *pc.MaxVersions
+	}
+	if pc.Format != "" {
+		cfg.Format = pc.Format
+	}
+	if len(pc.Ignore) > 0 {
+		cfg.Ignore = append(append([]string{}, cfg.Ignore...), pc.Ignore...)
+	}
+	if pc.Hooks != nil {
+		h := HooksConfig{}
+		if cfg.Hooks != nil {
+			h = *cfg.Hooks
+		}
+		if pc.Hooks.PreBackup != "" {
+			h.PreBackup = pc.Hooks.PreBackup
+		}
+		if pc.Hooks.PostBackup != "" {
+			h.PostBackup = pc.Hooks.PostBackup
+		}
+		cfg.Hooks = &h
+	}
+	return cfg
+}
+
+// projectName is the name of the project in srcAbs: the project config's
+// name, else the directory name.
+func projectName(srcAbs string) (string, error) {
+	pc, err := loadProjectConfig(srcAbs)
+	if err != nil {
+		return "", err
+	}
+	if pc != nil && pc.Name != "" {
+		return pc.Name, nil
+	}
+	return filepath.Base(srcAbs), nil
+}
+
+// -------------------- EFFECTIVE CONFIG --------------------
+
+// setting is one line of `bkup config show --effective`.
+type setting struct {
+	key    string
+	value  string // compact JSON
+	source string
+}
+
+// settingDefaults are shown for keys nobody set.
+var settingDefaults = map[string]any{
+	"queue":        false,
+	"incremental":  false,
+	"format":       "dir",
+	"copy_workers": defaultCopyWorkers,
+}
+
+// effectiveSettings lists every setting of the project in src: its merged
+// value and whether it came from the project config, config.json (cfgPath,
+// whose top-level keys are globalKeys) or the defaults.
+func effectiveSettings(global Config, globalKeys map[string]bool, cfgPath string, pc *ProjectConfig, src string) []setting {
+	merged, _ := json.Marshal(pc.apply(global))
+	var values map[string]json.RawMessage
+	_ = json.Unmarshal(merged, &values)
+
+	var projKeys map[string]json.RawMessage
+	if pc != nil {
+		b, _ := json.Marshal(pc)
+		_ = json.Unmarshal(b, &projKeys)
+	}
+
+	keys := []string{"name", "queue"}
+	t := reflect.TypeFor[Config]()
+	for i := 0; i < t.NumField(); i++ {
+		if k, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); k != "" && k != "-" {
+			keys = append(keys, k)
+		}
+	}
+
+	var out []setting
+	for _, k := range keys {
+		s := setting{key: k, source: "default"}
+		var sources []string
+		if globalKeys[k] && k != "name" && k != "queue" {
+			sources = append(sources, cfgPath)
+		}
+		if _, ok := projKeys[k]; ok {
+			if k != "ignore" && k != "hooks" {
+				sources = nil // replaced, not merged
+			}
+			sources = append(sources, pc.path)
+		}
+		if len(sources) > 0 {
+			s.source = strings.Join(sources, " + ")
+		}
+
+		raw, ok := values[k]
+		switch {
+		case k == "name":
+			name := filepath.Base(src)
+			if pc != nil && pc.Name != "" {
+				name = pc.Name
+			} else {
+				s.source = "default (directory name)"
+			}
+			raw, _ = json.Marshal(name)
+		case k == "queue":
+			raw = projKeys["queue"]
+		case !ok && settingDefaults[k] == nil:
+			s.value = "(not set)"
+		}
+		if s.value == "" {
+			if raw == nil {
+				raw, _ = json.Marshal(settingDefaults[k])
+			}
+			var buf bytes.Buffer
+			if json.Compact(&buf, raw) == nil {
+				raw = buf.Bytes()
+			}
+			s.value = string(raw)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// configKeys returns the top-level keys set in the JSON file at path.
+func configKeys(path string) (map[string]bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	keys := make(map[string]bool, len(m))
+	for k := range m {
+		keys[k] = true
+	}
+	return keys, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- PRUNE COMMAND --------------------
+//
+// `bkup prune` deletes versions of the current project selected by age, count
+// and total size:
+//   --older-than D  versions created more than D ago (e.g. 36h, 14d, 2w)
+//   --keep-last N   never touch the newest N full versions (and partial ones
+//                   between them); alone, delete everything older
+//   --max-size S    delete oldest first until the project uses at most S (e.g. 2G)
+// Pinned and tagged versions are never pruned. Space is counted per inode, so a file that
+// is hard-linked into a version that stays (incremental mode) frees nothing.
+
+type pruneOptions struct {
+	olderThan time.Duration // 0 = no age filter
+	keepLast  int           // -1 = not given
+	maxSize   int64         // 0 = no size cap
+	dryRun    bool
+}
+
+type pruneItem struct {
+	v      Version
+	reason string
+	frees  int64
+}
+
+// runPrune implements `bkup prune`.
+func runPrune(w io.Writer, backupRoot, cwdAbs string, opts pruneOptions) error {
+	if opts.olderThan <= 0 && opts.keepLast < 0 && opts.maxSize <= 0 {
+		return errors.New("prune needs at least one of --older-than, --keep-last or --max-size")
+	}
+	proj, err := resolveProject(backupRoot, cwdAbs)
+	if err != nil {
+		return err
+	}
+	if !opts.dryRun {
+		lock, err := lockProject(backupRoot, proj)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+	vers, err := listProjectVersions(proj.Root, proj.Name)
+	if err != nil {
+		return err
+	}
+	if len(vers) == 0 {
+		fmt.Fprintln(w, "(no backups found)")
+		return nil
+	}
+
+	usage, err := scanUsage(vers)
+	if err != nil {
+		return err
+	}
+	plan := planPrune(vers, usage, opts, time.Now())
+
+	if len(plan) == 0 {
+		fmt.Fprintf(w, "Nothing to prune (%d backup(s), %s).\n", len(vers), formatBytes(usage.total()))
+		return nil
+	}
+	if opts.dryRun {
+		fmt.Fprintln(w, "Would delete (dry run):")
+	} else {
+		fmt.Fprintln(w, "Deleting:")
+	}
+	var freed int64
+	chunked := false
+	for _, it := range plan {
+		fmt.Fprintf(w, "%s  (frees %s; %s)\n", formatVersionLine(it.v), formatBytes(it.frees), it.reason)
+		freed += it.frees
+		chunked = chunked || it.v.Format == formatChunked
+	}
+	if opts.maxSize > 0 && usage.total() > opts.maxSize {
+		fmt.Fprintf(w, "Still %s over --max-size: the remaining backups are pinned or kept by --keep-last.\n",
+			formatBytes(usage.total()-opts.maxSize))
+	}
+
+	if !opts.dryRun {
+		for _, it := range plan {
+			if err := removeVersion(it.v); err != nil {
+				return fmt.Errorf("remove %s: %w", it.v.Path, err)
+			}
+		}
+	}
+	verb := "Freed"
+	if opts.dryRun {
+		verb = "Would free"
+	}
+	fmt.Fprintf(w, "%s %s in %d backup(s); %d left using %s.\n",
+		verb, formatBytes(freed), len(plan), len(vers)-len(plan), formatBytes(usage.total()))
+	if chunked {
+		fmt.Fprintln(w, "Chunked backups only drop their manifest here; run `bkup gc` to free unreferenced chunks.")
+	}
+	return nil
+}
+
+// planPrune picks the versions to delete, oldest first, and removes them from
+// usage as it goes so each item's frees reflects what the deletions before it
+// already released.
+func planPrune(vers []Version, usage *diskUsage, opts pruneOptions, now time.Time) []pruneItem {
+	sorted := append([]Version(nil), vers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		// Newest first; tie-breaker: higher N.
+		if sorted[i].CreatedUnix == sorted[j].CreatedUnix {
+			return sorted[i].N > sorted[j].N
+		}
+		return sorted[i].CreatedUnix > sorted[j].CreatedUnix
+	})
+
+	// --keep-last counts full versions only; partial ones newer than the
+	// oldest of them are kept along with them.
+	keep := make([]bool, len(sorted))
+	full := 0
+	for i, v := range sorted {
+		keep[i] = v.exempt() || (opts.keepLast >= 0 && full < opts.keepLast)
+		if !v.partial() {
+			full++
+		}
+	}
+
+	var plan []pruneItem
+	deleted := make([]bool, len(sorted))
+	drop := func(i int, reason string) {
+		deleted[i] = true
+		plan = append(plan, pruneItem{v: sorted[i], reason: reason, frees: usage.remove(sorted[i].N)})
+	}
+
+	// Oldest first, so the age and count passes free space in the order the size pass would.
+	cutoff := now.Add(-opts.olderThan).Unix()
+	for i := len(sorted) - 1; i >= 0; i-- {
+		switch {
+		case keep[i]:
+		case opts.olderThan > 0 && sorted[i].CreatedUnix < cutoff:
+			drop(i, "older than "+formatAge(opts.olderThan))
+		case opts.olderThan <= 0 && opts.maxSize <= 0:
+			// --keep-last on its own.
+			drop(i, fmt.Sprintf("beyond --keep-last %d", opts.keepLast))
+		}
+	}
+	if opts.maxSize > 0 {
+		for i := len(sorted) - 1; i >= 0 && usage.total() > opts.maxSize; i-- {
+			if !keep[i] && !deleted[i] {
+				drop(i, "over --max-size "+formatBytes(opts.maxSize))
+			}
+		}
+	}
+	return plan
+}
+
+// -------------------- DISK USAGE --------------------
+
+type inodeUsage struct {
+	size  int64
+	refs  int  // paths referencing it inside the scanned versions
+	extra bool // also linked from outside the scanned versions: never freed
+}
+
+// diskUsage tracks the bytes used by a set of versions, counting each inode once.
+type diskUsage struct {
+	inodes    map[[2]uint64]*inodeUsage
+	byVersion map[int][][2]uint64
+	used      int64
+}
+
+func scanUsage(vers []Version) (*diskUsage, error) {
+	u := &diskUsage{inodes: map[[2]uint64]*inodeUsage{}, byVersion: map[int][][2]uint64{}}
+	nlinks := map[[2]uint64]uint64{}
+	var next uint64 // synthetic ids where the platform has no inode numbers
+
+	for _, v := range vers {
+		if v.Remote {
+			continue // takes no local space
+		}
+		err := filepath.WalkDir(v.Path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			id, nlink, ok := fileID(info)
+			if !ok {
+				next++
+				id, nlink = [2]uint64{^uint64(0), next}, 1
+			}
+			in := u.inodes[id]
+			if in == nil {
+				in = &inodeUsage{size: info.Size()}
+				u.inodes[id] = in
+				u.used += in.size
+			}
+			in.refs++
+			nlinks[id] = nlink
+			u.byVersion[v.N] = append(u.byVersion[v.N], id)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan %s: %w", v.Path, err)
+		}
+	}
+	for id, in := range u.inodes {
+		in.extra = nlinks[id] > uint64(in.refs)
+	}
+	return u, nil
+}
+
+func (u *diskUsage) total() int64 { return u.used }
+
+// remove drops version n from the usage and returns the bytes that deleting it frees.
+func (u *diskUsage) remove(n int) int64 {
+	var freed int64
+	for _, id := range u.byVersion[n] {
+		in := u.inodes[id]
+		in.refs--
+		if in.refs == 0 {
+			u.used -= in.size
+			if !in.extra {
+				freed += in.size
+			}
+		}
+	}
+	delete(u.byVersion, n)
+	return freed
+}
+
+// -------------------- FLAG VALUES --------------------
+
+// parseAge parses a duration, accepting d (days) and w (weeks) on top of
+// time.ParseDuration units: 14d, 2w, 36h, 90m.
+func parseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid age %q (examples: 14d, 2w, 36h)", s)
+		}
+		return time.Duration(n * float64(unit)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid age %q (examples: 14d, 2w, 36h)", s)
+	}
+	return d, nil
+}
+
+func formatAge(d time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case d%(7*day) == 0:
+		return fmt.Sprintf("%dw", d/(7*day))
+	case d%day == 0:
+		return fmt.Sprintf("%dd", d/day)
+	}
+	return d.String()
+}
+
+// parseSize parses a byte count with an optional binary unit: 2G, 500M, 1.5GiB, 4096.
+func parseSize(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	t = strings.TrimSuffix(strings.TrimSuffix(t, "B"), "I")
+	mult := int64(1)
+	if i := strings.IndexAny(t, "KMGTP"); i >= 0 && i == len(t)-1 {
+		mult = int64(1) << (10 * (strings.IndexByte("KMGTP", t[i]) + 1))
+		t = t[:i]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q (examples: 2G, 500M, 1.5GiB)", s)
+	}
+	return int64(n * float64(mult)), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeUsage gives every version its own 100-byte file.
+func fakeUsage(vers []Version) *diskUsage {
+	u := &diskUsage{inodes: map[[2]uint64]*inodeUsage{}, byVersion: map[int][][2]uint64{}}
+	for _, v := range vers {
+		id := [2]uint64{0, uint64(v.N)}
+		u.inodes[id] = &inodeUsage{size: 100, refs: 1}
+		u.byVersion[v.N] = [][2]uint64{id}
+		u.used += 100
+	}
+	return u
+}
+
+func TestPlanPrune(t *testing.T) {
+	full := func(n int) Version { return Version{N: n, CreatedUnix: at(n)} }
+	partial := func(n int) Version { return Version{N: n, CreatedUnix: at(n), Paths: []string{"a.txt"}} }
+	pinned := func(n int) Version { return Version{N: n, CreatedUnix: at(n), Pinned: true} }
+	tagged := func(n int) Version { return Version{N: n, CreatedUnix: at(n), Tags: []string{"good"}} }
+	none := pruneOptions{keepLast: -1}
+
+	tests := []struct {
+		name   string
+		vers   []Version
+		opts   func(o *pruneOptions)
+		delete []int // in plan order: oldest first
+	}{
+		{"keep-last alone", []Version{full(1), full(2), full(3), full(4), full(5)},
+			func(o *pruneOptions) { o.keepLast = 2 }, []int{1, 2, 3}},
+		{"keep-last counts full versions",
+			[]Version{full(1), full(2), full(3), full(4), partial(5)},
+			func(o *pruneOptions) { o.keepLast = 2 }, []int{1, 2}},
+		{"partial beyond keep-last",
+			[]Version{full(1), full(2), full(3), partial(4), full(5)},
+			func(o *pruneOptions) { o.keepLast = 1 }, []int{1, 2, 3, 4}},
+		{"keep-last 0 spares exempt versions",
+			[]Version{full(1), pinned(2), full(3), tagged(4), full(5)},
+			func(o *pruneOptions) { o.keepLast = 0 }, []int{1, 3, 5}},
+		{"older-than", []Version{full(1), full(2), full(3), full(4), full(5)},
+			func(o *pruneOptions) { o.olderThan = 7 * time.Hour }, []int{1, 2}},
+		{"older-than with keep-last", []Version{full(1), full(2), full(3), full(4), full(5)},
+			func(o *pruneOptions) { o.olderThan = time.Hour; o.keepLast = 3 }, []int{1, 2}},
+		{"max-size deletes oldest first", []Version{pinned(1), full(2), full(3), full(4), full(5)},
+			func(o *pruneOptions) { o.maxSize = 250 }, []int{2, 3, 4}},
+		{"max-size stops at keep-last", []Version{full(1), full(2), full(3), full(4), full(5)},
+			func(o *pruneOptions) { o.maxSize = 100; o.keepLast = 3 }, []int{1, 2}},
+		{"age before size", []Version{full(1), full(2), full(3), tagged(4), full(5)},
+			func(o *pruneOptions) { o.olderThan = 8 * time.Hour; o.maxSize = 100 }, []int{1, 2, 3, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := none
+			tt.opts(&opts)
+			usage := fakeUsage(tt.vers)
+			plan := planPrune(tt.vers, usage, opts, time.Unix(at(10), 0))
+			var got []int
+			var freed int64
+			for _, it := range plan {
+				got = append(got, it.v.N)
+				freed += it.frees
+			}
+			if !reflect.DeepEqual(got, tt.delete) {
+				t.Errorf("plan deletes %v, want %v", got, tt.delete)
+			}
+			if want := int64(100 * len(tt.delete)); freed != want || usage.total() != int64(100*len(tt.vers))-want {
+				t.Errorf("plan frees %d and leaves %d, want %d freed", freed, usage.total(), want)
+			}
+		})
+	}
+}
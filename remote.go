@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- REMOTE SYNC --------------------
+//
+// With a remote backend the local backup root is a working cache of it:
+//   - a version is uploaded right after it is written (stale keys of an
+//     overwritten slot are deleted first; the meta file goes up last, so a
+//     remote slot without meta is incomplete and never listed)
+//   - meta changes (note, pin, tag) and project/keyring files are uploaded too
+//   - deleting a version (FIFO, retention, prune, clean, cleanse) deletes it remotely
+//   - versions that only exist remotely are listed, and downloaded into their
+//     local slot the first time they are used
+//
+// A local slot is complete when its meta file exists, which is why downloads
+// also write meta last.
+
+// pushVersion uploads the slot dir dst to the remote backend, if there is one.
+func pushVersion(dst string) error {
+	backupRoot := slotRoot(dst)
+	remote := remoteFor(backupRoot)
+	if remote == nil {
+		return nil
+	}
+	local := &localBackend{root: backupRoot}
+	slotKey, err := backendKey(backupRoot, dst)
+	if err != nil {
+		return err
+	}
+	if err := deletePrefix(remote, slotKey+"/"); err != nil {
+		return err
+	}
+	if err := pushFile(backupRoot, filepath.Join(filepath.Dir(dst), projectFileName)); err != nil {
+		return err
+	}
+
+	// Chunks first: a listed version must never reference missing objects.
+	ids, err := slotObjectIDs(dst)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		key := objectKey(id)
+		if _, err := remote.Stat(key); err == nil {
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := copyObject(remote, local, key); err != nil {
+			return err
+		}
+	}
+
+	objs, err := local.List(slotKey + "/")
+	if err != nil {
+		return err
+	}
+	metaKey := slotKey + "/" + metaFileName
+	for _, o := range objs {
+		if o.Key == metaKey {
+			continue
+		}
+		if err := copyObject(remote, local, o.Key); err != nil {
+			return err
+		}
+	}
+	return copyObject(remote, local, metaKey)
+}
+
+// pushFile uploads one file under backupRoot (a meta, project or keyring file).
+func pushFile(backupRoot, p string) error {
+	remote := remoteFor(backupRoot)
+	if remote == nil {
+		return nil
+	}
+	key, err := backendKey(backupRoot, p)
+	if err != nil {
+		return err
+	}
+	return copyObject(remote, &localBackend{root: backupRoot}, key)
+}
+
+// fetchFile downloads one file under backupRoot unless it exists locally.
+// It is not an error if the remote does not have it either.
+func fetchFile(backupRoot, p string) error {
+	remote := remoteFor(backupRoot)
+	if remote == nil {
+		return nil
+	}
+	if _, err := os.Lstat(p); err == nil {
+		return nil
+	}
+	key, err := backendKey(backupRoot, p)
+	if err != nil {
+		return err
+	}
+	err = copyObject(&localBackend{root: backupRoot}, remote, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// removeVersion deletes a slot locally and remotely.
+func removeVersion(v Version) error {
+	if err := os.RemoveAll(v.Path); err != nil {
+		return err
+	}
+	return removeRemoteDir(slotRoot(v.Path), v.Path)
+}
+
+// removeRemoteDir deletes every remote object under the local dir p.
+func removeRemoteDir(backupRoot, p string) error {
+	remote := remoteFor(backupRoot)
+	if remote == nil {
+		return nil
+	}
+	key, err := backendKey(backupRoot, p)
+	if err != nil {
+		return err
+	}
+	return deletePrefix(remote, key+"/")
+}
+
+// cleanseRemote deletes every remote object except the keyring.
+func cleanseRemote(backupRoot string) error {
+	remote := remoteFor(backupRoot)
+	if remote == nil {
+		return nil
+	}
+	objs, err := remote.List("")
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if o.Key == keyringFileName {
+			continue
+		}
+		if err := remote.Delete(o.Key); err != nil {
+			return fmt.Errorf("delete %s from %s: %w", o.Key, remote, err)
+		}
+	}
+	return nil
+}
+
+// remoteVersions lists the complete remote versions of a project that are not
+// in local (slot names that exist locally).
+func remoteVersions(projectRoot, project string, local map[string]bool) ([]Version, error) {
+	backupRoot := filepath.Dir(projectRoot)
+	remote := remoteFor(backupRoot)
+	if remote == nil {
+		return nil, nil
+	}
+	projectKey, err := backendKey(backupRoot, projectRoot)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := remote.List(projectKey + "/" + project + "_")
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", remote, err)
+	}
+
+	var out []Version
+	for _, o := range objs {
+		rest := strings.TrimPrefix(o.Key, projectKey+"/")
+		slot, file, ok := strings.Cut(rest, "/")
+		if !ok || file != metaFileName || local[slot] {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(slot, project+"_"))
+		if err != nil {
+			continue
+		}
+		m, err := getRemoteMeta(remote, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, versionFromMeta(n, filepath.Join(projectRoot, slot), m, true))
+	}
+	return out, nil
+}
+
+func getRemoteMeta(remote Backend, key string) (Meta, error) {
+	r, err := remote.Get(key)
+	if err != nil {
+		return Meta{}, err
+	}
+	defer r.Close()
+	var m Meta
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return Meta{}, fmt.Errorf("parse %s/%s: %w", remote, key, err)
+	}
+	return m, nil
+}
+
+// fetchVersion makes a remote-only slot complete locally. Slots that already
+// have a local meta file are left alone.
+func fetchVersion(slotDir string) error {
+	backupRoot := slotRoot(slotDir)
+	remote := remoteFor(backupRoot)
+	if remote == nil {
+		return nil
+	}
+	if _, err := os.Stat(metaPathForDir(slotDir)); err == nil {
+		return nil
+	}
+	slotKey, err := backendKey(backupRoot, slotDir)
+	if err != nil {
+		return err
+	}
+	objs, err := remote.List(slotKey + "/")
+	if err != nil {
+		return fmt.Errorf("list %s: %w", remote, err)
+	}
+	metaKey := slotKey + "/" + metaFileName
+	hasMeta := false
+	for _, o := range objs {
+		hasMeta = hasMeta || o.Key == metaKey
+	}
+	if !hasMeta {
+		return nil // nothing complete to fetch; callers report the missing version
+	}
+
+	local := &localBackend{root: backupRoot}
+	_ = os.RemoveAll(slotDir)
+	fail := func(err error) error {
+		_ = os.RemoveAll(slotDir)
+		return fmt.Errorf("fetch %s from %s: %w", filepath.Base(slotDir), remote, err)
+	}
+	for _, o := range objs {
+		if o.Key == metaKey {
+			continue
+		}
+		if err := copyObject(local, remote, o.Key); err != nil {
+			return fail(err)
+		}
+	}
+
+	ids, err := slotObjectIDs(slotDir)
+	if err != nil {
+		return fail(err)
+	}
+	for _, id := range ids {
+		if _, err := os.Stat(objectPath(objectsDir(backupRoot), id)); err == nil {
+			continue
+		}
+		if err := copyObject(local, remote, objectKey(id)); err != nil {
+			return fail(err)
+		}
+	}
+
+	m, err := getRemoteMeta(remote, metaKey)
+	if err != nil {
+		return fail(err)
+	}
+	if normalizeFormat(m.Format) == formatDir {
+		if err := restoreTreeMetadata(slotDir); err != nil {
+			return fail(err)
+		}
+	}
+	if err := copyObject(local, remote, metaKey); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// restoreTreeMetadata recreates what objects cannot carry for a downloaded
+// dir-format slot: empty dirs, symlinks, permissions and mtimes (from its manifest).
+func restoreTreeMetadata(slotDir string) error {
+	m, err := readManifest(slotDir, nil)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // legacy version without a manifest: plain files only
+		}
+		return err
+	}
+	var dirs []ManifestEntry
+	for _, e := range m.Entries {
+		p := filepath.Join(slotDir, filepath.FromSlash(e.Path))
+		mtime := time.Unix(0, e.MTimeNs)
+		switch e.Type {
+		case entryDir:
+			if err := os.MkdirAll(p, 0o755); err != nil {
+				return err
+			}
+			dirs = append(dirs, e)
+		case entrySymlink:
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				return err
+			}
+			_ = os.Remove(p)
+			if err := os.Symlink(e.Link, p); err != nil {
+				return err
+			}
+		case entryFile:
+			if err := os.Chmod(p, fs.FileMode(e.Mode)); err != nil {
+				return err
+			}
+			if err := os.Chtimes(p, mtime, mtime); err != nil {
+				return err
+			}
+		}
+	}
+	// Dirs last (deepest first), since filling them changed their mtimes.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		e := dirs[i]
+		p := filepath.Join(slotDir, filepath.FromSlash(e.Path))
+		mtime := time.Unix(0, e.MTimeNs)
+		if err := os.Chmod(p, fs.FileMode(e.Mode)); err != nil {
+			return err
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slotObjectIDs returns the chunk objects a slot references (none unless chunked).
+func slotObjectIDs(slotDir string) ([]string, error) {
+	if b, err := os.ReadFile(filepath.Join(slotDir, objectListFileName)); err == nil {
+		return strings.Fields(string(b)), nil
+	}
+	m, err := readManifest(slotDir, nil)
+	if err != nil {
+		// No manifest (legacy), or a sealed archive's: no chunks either way,
+		// since encrypted chunked slots always carry an object list.
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errSealed) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, e := range m.Entries {
+		ids = append(ids, e.Chunks...)
+	}
+	return ids, nil
+}
+
+// objectKey is the backend key of a chunk object.
+func objectKey(id string) string {
+	return path.Join(objectsDirName, id[:2], id)
+}
+
+// readAllObject reads a whole object from a backend.
+func readAllObject(be Backend, key string) ([]byte, error) {
+	r, err := be.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
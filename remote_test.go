@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readTree returns every file, dir and symlink under dir (bkup's own files
+// left out) as rel path -> contents, "dir" or "-> target".
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	out := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		rel = filepath.ToSlash(rel)
+		if isInternalFile(rel) || strings.HasPrefix(rel, ".bkup") {
+			return nil
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			out[rel] = "-> " + target
+			return err
+		case d.IsDir():
+			out[rel] = "dir"
+		default:
+			b, err := os.ReadFile(p)
+			out[rel] = string(b)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRemoteRoundTrip backs a project up to the S3 fake, wipes the local
+// backup root (a fresh machine) and pulls the version back from the bucket.
+func TestRemoteRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"dir", Config{MaxVersions: 10}},
+		{"incremental", Config{MaxVersions: 10, Incremental: true}},
+		{"chunked", Config{MaxVersions: 10, Format: formatChunked}},
+		{"tar.zst", Config{MaxVersions: 10, Format: formatTarZst}},
+		{"encrypted", Config{MaxVersions: 10, Encryption: &EncryptionConfig{Enabled: true}}},
+		{"encrypted chunked", Config{MaxVersions: 10, Format: formatChunked, Encryption: &EncryptionConfig{Enabled: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BKUP_PASSPHRASE", "correct horse battery staple")
+			f, bc := newFakeS3(t)
+			src, root := t.TempDir(), t.TempDir()
+			if err := attachBackend(root, bc); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { delete(remotes, root) })
+
+			writeFiles(t, src, map[string]string{
+				"a.txt":           "alpha\n",
+				"src/main.go":     "package main\n",
+				"src/deep/b.txt":  strings.Repeat("bravo ", 5000),
+				"name with space": "spaced\n",
+			})
+			if err := os.Mkdir(filepath.Join(src, "empty"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("a.txt", filepath.Join(src, "link")); err != nil {
+				t.Fatal(err)
+			}
+			want := readTree(t, src)
+
+			dst, err := backupNewVersion(src, root, tt.cfg, backupOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			slotKey, _ := backendKey(root, dst)
+			if len(f.keys(slotKey+"/"+metaFileName)) != 1 {
+				t.Fatalf("%s was not uploaded; bucket has %q", slotKey, f.keys(""))
+			}
+
+			// A fresh machine: nothing local but the remote.
+			if err := os.RemoveAll(root); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(root, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			writeFiles(t, src, map[string]string{"a.txt": "changed\n", "added.txt": "new\n"})
+			if err := os.Remove(filepath.Join(src, "src", "main.go")); err != nil {
+				t.Fatal(err)
+			}
+
+			proj, err := resolveProject(root, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proj.Root != filepath.Dir(dst) {
+				t.Fatalf("project resolved to %s after the wipe, want %s", proj.Root, filepath.Dir(dst))
+			}
+			vers, err := listProjectVersions(proj.Root, proj.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vers) != 1 || !vers[0].Remote || vers[0].Path != dst {
+				t.Fatalf("versions after the wipe = %+v, want %s as a remote version", vers, dst)
+			}
+
+			e := &env{backupRoot: root, global: tt.cfg, cfg: tt.cfg, cwd: src, src: src, statePath: filepath.Join(t.TempDir(), stateFileName)}
+			if err := cmdPull(e, nil); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTree(t, src); !reflect.DeepEqual(got, want) {
+				t.Errorf("tree after pull:\n got %v\nwant %v", got, want)
+			}
+
+			// The pulled version is complete locally and passes verify.
+			v, err := findVersion(proj.Root, proj.Name, vers[0].N)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Remote {
+				t.Errorf("%s is still remote-only after the pull", v.Path)
+			}
+			res, err := verifyVersion(root, tt.cfg, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.ok() || res.NoManifest {
+				t.Errorf("verify after download: %+v", res)
+			}
+		})
+	}
+}
+
+// TestRemoteDeleteFollowsLocal checks that versions removed locally (here by
+// -q overwriting the oldest slot) are removed from the bucket too.
+func TestRemoteDeleteFollowsLocal(t *testing.T) {
+	f, bc := newFakeS3(t)
+	src, root := t.TempDir(), t.TempDir()
+	if err := attachBackend(root, bc); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { delete(remotes, root) })
+
+	cfg := Config{MaxVersions: 2}
+	var slots []string
+	for _, content := range []string{"one", "two", "three"} {
+		old, _ := filepath.Glob(filepath.Join(src, "only-in-*"))
+		for _, p := range old {
+			if err := os.Remove(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeFiles(t, src, map[string]string{"only-in-" + content: content})
+		dst, err := backupNewVersion(src, root, cfg, backupOptions{queueMode: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slots = append(slots, dst)
+	}
+	if slots[2] != slots[0] {
+		t.Fatalf("third backup went to %s, want the oldest slot %s", slots[2], slots[0])
+	}
+	slotKey, _ := backendKey(root, slots[0])
+	got := f.keys(slotKey + "/only-in-")
+	if !reflect.DeepEqual(got, []string{slotKey + "/only-in-three"}) {
+		t.Errorf("overwritten slot in the bucket holds %q, want only the new version's file", got)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// -------------------- TRANSACTIONAL REPLACE --------------------
+//
+// replaceDirContents (pull) never leaves the working dir half-replaced:
+//  1. the new tree is copied into <dst>/.bkup-pull-new-<pid>-*, which can take
+//     long and fail without touching anything
+//  2. the current (non-ignored) contents are renamed into
+//     <dst>/.bkup-pull-old-<pid>-* and the staged tree is renamed into place;
+//     every rename is journaled, and any failure renames everything back
+//  3. only then are the old contents deleted
+//
+// Both work dirs live inside dst, so every rename stays on one filesystem.
+// Ctrl-C is held off during step 2, which is only renames; once the swap is
+// committed or rolled back, bkup exits as interrupted (status 130, 143 for
+// SIGTERM).
+
+const pullDirPrefix = ".bkup-pull-"
+
+// renameJournal records renames so they can be undone in reverse order.
+type renameJournal struct {
+	done [][2]string // {from, to}
+}
+
+func (j *renameJournal) rename(from, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	j.done = append(j.done, [2]string{from, to})
+	return nil
+}
+
+func (j *renameJournal) rollback() error {
+	var errs []error
+	for i := len(j.done) - 1; i >= 0; i-- {
+		from, to := j.done[i][0], j.done[i][1]
+		if err := os.Rename(to, from); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	j.done = nil
+	return errors.Join(errs...)
+}
+
+// replaceDirContents replaces the contents of dstDir with the contents of srcDir,
+// leaving dstDir itself in place, as one transaction (see above). Paths matched
+// by ign are neither removed from dstDir nor copied from srcDir. The staging
+// copy uses workers parallel file copies.
+func replaceDirContents(dstDir, srcDir string, ign *ignoreMatcher, workers int) error {
+	dstDir = mustAbs(dstDir)
+	srcDir = mustAbs(srcDir)
+
+	if fi, err := os.Stat(dstDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("destination is not a directory: %s", dstDir)
+	}
+	if fi, err := os.Stat(srcDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("source is not a directory: %s", srcDir)
+	}
+	cleanStalePullDirs(dstDir)
+
+	prefix := fmt.Sprintf("%s%%s-%d-*", pullDirPrefix, os.Getpid())
+	stage, err := os.MkdirTemp(dstDir, fmt.Sprintf(prefix, "new"))
+	if err != nil {
+		return fmt.Errorf("create staging dir: %w", err)
+	}
+	defer os.RemoveAll(stage)
+
+	if err := copyDirContents(srcDir, stage, copyOptions{ignore: ign, workers: workers}); err != nil {
+		return fmt.Errorf("stage copy (working directory unchanged): %w", err)
+	}
+
+	aside, err := os.MkdirTemp(dstDir, fmt.Sprintf(prefix, "old"))
+	if err != nil {
+		return fmt.Errorf("create dir for the current contents (working directory unchanged): %w", err)
+	}
+
+	// A Ctrl-C now must not leave the swap half done: it is held until the
+	// swap is committed or rolled back, then reported (see interruptedError).
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, stopSignals...)
+	defer signal.Stop(sigs)
+
+	err = swapContents(dstDir, stage, aside, ign)
+	select {
+	case sig := <-sigs:
+		return &interruptedError{sig: sig, err: err}
+	default:
+		return err
+	}
+}
+
+// swapContents moves the contents of dstDir into aside and the staged tree into
+// dstDir, undoing every rename if one fails; then it deletes aside.
+func swapContents(dstDir, stage, aside string, ign *ignoreMatcher) error {
+	var j renameJournal
+	_, err := moveUnignored(dstDir, aside, "", ign, &j)
+	if err == nil {
+		err = moveTreeIn(stage, dstDir, "", &j)
+	}
+	if err != nil {
+		if rbErr := j.rollback(); rbErr != nil {
+			return fmt.Errorf("replace contents: %w; rolling back also failed: %v "+
+				"(files not moved back are in %s)", err, rbErr, aside)
+		}
+		_ = os.RemoveAll(aside)
+		return fmt.Errorf("replace contents: %w (rolled back; working directory unchanged)", err)
+	}
+	if err := os.RemoveAll(aside); err != nil {
+		warnf("pulled, but could not delete the previous contents in %s: %v", aside, err)
+	}
+	return nil
+}
+
+// interruptedError reports a signal that arrived while replaceDirContents held
+// it off. err is the outcome of the swap (nil: it completed). fatal exits with
+// signalExitCode(sig), as if the signal had not been caught.
+type interruptedError struct {
+	sig os.Signal
+	err error
+}
+
+func (e *interruptedError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("interrupted (%v), after the pull had completed", e.sig)
+	}
+	return fmt.Sprintf("%v (interrupted: %v)", e.err, e.sig)
+}
+
+func (e *interruptedError) Unwrap() error { return e.err }
+
+func (e *interruptedError) exitCode() int { return signalExitCode(e.sig) }
+
+// moveUnignored moves the non-ignored entries below root/rel to the same place
+// under aside and reports whether anything had to stay. Directories holding
+// ignored entries stay (with everything else inside moved).
+func moveUnignored(root, aside, rel string, ign *ignoreMatcher, j *renameJournal) (bool, error) {
+	entries, err := os.ReadDir(filepath.Join(root, rel))
+	if err != nil {
+		return false, err
+	}
+	kept := false
+	for _, e := range entries {
+		childRel := filepath.Join(rel, e.Name())
+		if rel == "" && strings.HasPrefix(e.Name(), pullDirPrefix) {
+			continue
+		}
+		if ign.Match(childRel, e.IsDir()) {
+			kept = true
+			continue
+		}
+		if e.IsDir() && holdsIgnored(root, childRel, ign) {
+			if err := os.MkdirAll(filepath.Join(aside, childRel), 0o700); err != nil {
+				return kept, err
+			}
+			if _, err := moveUnignored(root, aside, childRel, ign, j); err != nil {
+				return kept, err
+			}
+			kept = true
+			continue
+		}
+		if err := j.rename(filepath.Join(root, childRel), filepath.Join(aside, childRel)); err != nil {
+			return kept, err
+		}
+	}
+	return kept, nil
+}
+
+// holdsIgnored reports whether anything below root/rel is matched by ign.
+func holdsIgnored(root, rel string, ign *ignoreMatcher) bool {
+	if ign == nil {
+		return false
+	}
+	found := false
+	_ = filepath.WalkDir(filepath.Join(root, rel), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		r, _ := filepath.Rel(root, path)
+		if r != rel && ign.Match(r, d.IsDir()) {
+			found = true
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// moveTreeIn moves everything below stage/rel to the same place under dst,
+// merging into directories that stayed because they hold ignored entries.
+func moveTreeIn(stage, dst, rel string, j *renameJournal) error {
+	entries, err := os.ReadDir(filepath.Join(stage, rel))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		childRel := filepath.Join(rel, e.Name())
+		from, to := filepath.Join(stage, childRel), filepath.Join(dst, childRel)
+		fi, err := os.Lstat(to)
+		switch {
+		case os.IsNotExist(err):
+			if err := j.rename(from, to); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case fi.IsDir() && e.IsDir():
+			if err := moveTreeIn(stage, dst, childRel, j); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s is in the backup, but an ignored path of that name is in the way", childRel)
+		}
+	}
+	return nil
+}
+
+// cleanStalePullDirs deletes staging dirs left by pulls that died. Dirs with
+// contents moved aside by a pull that died mid-swap are kept and reported,
+// since they may hold the only copy of those files.
+func cleanStalePullDirs(dstDir string) {
+	ents, err := os.ReadDir(dstDir)
+	if err != nil {
+		return
+	}
+	for _, e := range ents {
+		name := e.Name()
+		if !e.IsDir() || !strings.HasPrefix(name, pullDirPrefix) {
+			continue
+		}
+		kind, rest, _ := strings.Cut(strings.TrimPrefix(name, pullDirPrefix), "-")
+		pidStr, _, _ := strings.Cut(rest, "-")
+		if pid, err := strconv.Atoi(pidStr); err == nil && processAlive(pid) {
+			continue
+		}
+		p := filepath.Join(dstDir, name)
+		if kind == "old" {
+			warnf("%s holds files moved aside by an interrupted pull; move back what you need, then delete it", p)
+			continue
+		}
+		_ = os.RemoveAll(p)
+	}
+}
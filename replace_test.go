@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestSwapContents runs the rename swap of a pull, including one that fails
+// halfway and must be rolled back by the journal.
+func TestSwapContents(t *testing.T) {
+	tests := []struct {
+		name    string
+		dst     map[string]string
+		stage   map[string]string
+		ignore  []string
+		want    map[string]string // dst afterwards, dirs left out
+		wantErr string
+	}{
+		{"replace",
+			map[string]string{"a.txt": "old", "gone.txt": "x", "src/b.txt": "old"},
+			map[string]string{"a.txt": "new", "src/b.txt": "new", "src/c.txt": "added"},
+			nil,
+			map[string]string{"a.txt": "new", "src/b.txt": "new", "src/c.txt": "added"}, ""},
+		{"ignored paths stay",
+			map[string]string{"a.txt": "old", "app.log": "log", "src/b.txt": "old", "src/debug.log": "log"},
+			map[string]string{"a.txt": "new", "src/b.txt": "new"},
+			[]string{"*.log"},
+			map[string]string{"a.txt": "new", "app.log": "log", "src/b.txt": "new", "src/debug.log": "log"}, ""},
+		{"rolled back",
+			map[string]string{"a.txt": "old", "b/c.txt": "old", "z.log": "ignored file"},
+			map[string]string{"a.txt": "new", "b/c.txt": "new", "z.log/d.txt": "in the backup"},
+			[]string{"*.log"},
+			map[string]string{"a.txt": "old", "b/c.txt": "old", "z.log": "ignored file"},
+			"an ignored path of that name is in the way"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, stage, aside := t.TempDir(), t.TempDir(), filepath.Join(t.TempDir(), "aside")
+			if err := os.Mkdir(aside, 0o700); err != nil {
+				t.Fatal(err)
+			}
+			writeFiles(t, dst, tt.dst)
+			writeFiles(t, stage, tt.stage)
+			var ign *ignoreMatcher
+			if tt.ignore != nil {
+				ign = &ignoreMatcher{}
+				for _, p := range tt.ignore {
+					if err := ign.add(p); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			err := swapContents(dst, stage, aside, ign)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "rolled back")):
+				t.Fatalf("err = %v, want a rolled back %q", err, tt.wantErr)
+			}
+			got := readTree(t, dst)
+			for rel, v := range got {
+				if v == "dir" {
+					delete(got, rel)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dst after the swap:\n got %v\nwant %v", got, tt.want)
+			}
+			if _, err := os.Stat(aside); !os.IsNotExist(err) {
+				t.Errorf("aside dir left behind: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// -------------------- PATH SELECTION --------------------
+
+// pathSelector selects paths (relative to the project root) named on the
+// command line. Patterns may use globs (*, ?, [...], **); a pattern that
+// names a directory selects everything below it.
+type pathSelector struct {
+	patterns []string
+	res      []*regexp.Regexp
+	roots    []string // literal (glob-free) leading directories of each pattern
+}
+
+func newPathSelector(patterns []string) (*pathSelector, error) {
+	s := &pathSelector{}
+	for _, raw := range patterns {
+		p := filepath.ToSlash(strings.TrimSpace(raw))
+		p = strings.TrimSuffix(path.Clean(p), "/")
+		if p == "" || p == "." {
+			return nil, fmt.Errorf("invalid path %q: name a file or directory inside the project", raw)
+		}
+		if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return nil, fmt.Errorf("invalid path %q: must be relative to the project root", raw)
+		}
+		re, err := regexp.Compile("^" + globToRegexp(p) + "(?:/.*)?$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", raw, err)
+		}
+		s.patterns = append(s.patterns, p)
+		s.res = append(s.res, re)
+		s.roots = append(s.roots, literalPrefix(p))
+	}
+	return s, nil
+}
+
+// literalPrefix returns the leading path segments of p that contain no glob characters.
+func literalPrefix(p string) string {
+	segs := strings.Split(p, "/")
+	n := 0
+	for n < len(segs) && !strings.ContainsAny(segs[n], `*?[\`) {
+		n++
+	}
+	if n == len(segs) {
+		n-- // the last segment is the selected entry itself
+	}
+	return strings.Join(segs[:n], "/")
+}
+
+// Match reports whether rel is selected (or lies inside a selected directory).
+// bkup's own files at the slot root are never selected.
+func (s *pathSelector) Match(rel string) bool {
+	return s == nil || s.matchIndex(rel) >= 0
+}
+
+// matchIndex returns the index of the first pattern matching rel, or -1.
+func (s *pathSelector) matchIndex(rel string) int {
+	rel = filepath.ToSlash(rel)
+	if isInternalFile(rel) {
+		return -1
+	}
+	for i, re := range s.res {
+		if re.MatchString(rel) {
+			return i
+		}
+	}
+	return -1
+}
+
+// MayContain reports whether the directory rel could hold a selected path.
+func (s *pathSelector) MayContain(rel string) bool {
+	if s == nil {
+		return true
+	}
+	rel = filepath.ToSlash(rel)
+	for _, root := range s.roots {
+		if root == "" || rel == root || strings.HasPrefix(root, rel+"/") || strings.HasPrefix(rel, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// -------------------- RESTORE COMMAND --------------------
+
+// runRestore implements `bkup restore <n> <path>...`: it safety-backs up just the
+// selected paths in cwdAbs, then replaces them with their contents from backup n.
+// Selected directories are restored exactly (files added since are removed);
+// ignored paths and everything outside the selection are left alone.
+func runRestore(w io.Writer, backupRoot string, cfg Config, cwdAbs, ref string, patterns []string, queueMode bool, jobs int) error {
+	proj, err := resolveProject(backupRoot, cwdAbs)
+	if err != nil {
+		return err
+	}
+	project, projectRoot := proj.Name, proj.Root
+	lock, err := lockProject(backupRoot, proj)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	v, err := resolveVersionRef(projectRoot, project, ref)
+	if err != nil {
+		return err
+	}
+	warnForeignVersion(proj, v)
+	sel, err := newPathSelector(patterns)
+	if err != nil {
+		return err
+	}
+	ign, err := loadIgnoreMatcher(cwdAbs, backupRoot, cfg)
+	if err != nil {
+		return err
+	}
+
+	treeDir, cleanup, err := materializeVersion(backupRoot, cfg, v)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// Every pattern must name something in the backup before anything is touched.
+	opts := copyOptions{ignore: ign, only: sel}
+	inBackup := make([]bool, len(patterns))
+	if err := walkSource(treeDir, opts, func(_, rel string, _ fs.DirEntry) error {
+		if i := sel.matchIndex(rel); i >= 0 {
+			inBackup[i] = true
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for i, ok := range inBackup {
+		if !ok {
+			return fmt.Errorf("%q matches nothing in %s", patterns[i], v.Path)
+		}
+	}
+
+	// Top-most selected paths currently in the working dir (what will be replaced).
+	var affected []string
+	if err := walkSource(cwdAbs, opts, func(_, rel string, d fs.DirEntry) error {
+		affected = append(affected, rel)
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if len(affected) > 0 {
+		safetyDst, err := backupNewVersion(cwdAbs, backupRoot, cfg, backupOptions{
+			queueMode:     queueMode,
+			protectedNums: map[int]bool{v.N: true},
+			only:          sel,
+			message:       fmt.Sprintf("safety backup before restoring %s from %s", strings.Join(patterns, ", "), filepath.Base(v.Path)),
+			jobs:          jobs,
+		})
+		if err != nil {
+			return fmt.Errorf("refusing to restore because a safety backup cannot be created first: %w", err)
+		}
+		fmt.Fprintf(w, "Safety backup of %d path(s) created: %s\n", len(affected), safetyDst)
+	}
+
+	for _, rel := range affected {
+		full := filepath.Join(cwdAbs, rel)
+		fi, err := os.Lstat(full)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			// Keep ignored entries inside; the dir itself is reused.
+			if _, err := removeUnignored(cwdAbs, rel, ign); err != nil {
+				return fmt.Errorf("clear %s: %w", rel, err)
+			}
+			continue
+		}
+		if err := os.Remove(full); err != nil {
+			return fmt.Errorf("remove %s: %w", rel, err)
+		}
+	}
+
+	opts.workers = copyWorkers(cfg, jobs)
+	if err := copyDirContents(treeDir, cwdAbs, opts); err != nil {
+		return fmt.Errorf("restore from %s: %w", v.Path, err)
+	}
+	fmt.Fprintf(w, "Restored %s from %s\n", strings.Join(patterns, ", "), v.Path)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// -------------------- RETENTION (grandfather-father-son) --------------------
+//
+// With a "retention" block in config.json, every new backup is followed by a
+// prune of the project's versions. Walking from newest to oldest, a version is
+// kept if it is one of the newest keep_last, or the newest version of one of
+// the newest keep_hourly hours (keep_daily days, keep_weekly ISO weeks,
+// keep_monthly months) that have a backup. Buckets use local time.
+//
+// Pinned and tagged versions, the newest version and any slot the caller protects are
+// always kept. Partial versions (restore's safety backups) are never counted as
+// the newest, toward keep_last or as a bucket's backup; they are kept while
+// they are newer than the oldest version keep_last keeps. max_versions still caps the number of slots; set it to -1 to let
+// retention alone decide how many versions exist.
+
+type Retention struct {
+	KeepLast    int `json:"keep_last,omitempty"`
+	KeepHourly  int `json:"keep_hourly,omitempty"`
+	KeepDaily   int `json:"keep_daily,omitempty"`
+	KeepWeekly  int `json:"keep_weekly,omitempty"`
+	KeepMonthly int `json:"keep_monthly,omitempty"`
+}
+
+// enabled reports whether r keeps anything; an empty block disables pruning.
+func (r *Retention) enabled() bool {
+	return r != nil && r.KeepLast+r.KeepHourly+r.KeepDaily+r.KeepWeekly+r.KeepMonthly > 0
+}
+
+func (r *Retention) validate() error {
+	if r == nil {
+		return nil
+	}
+	for _, k := range []struct {
+		name string
+		n    int
+	}{
+		{"keep_last", r.KeepLast}, {"keep_hourly", r.KeepHourly}, {"keep_daily", r.KeepDaily},
+		{"keep_weekly", r.KeepWeekly}, {"keep_monthly", r.KeepMonthly},
+	} {
+		if k.n < 0 {
+			return fmt.Errorf("retention.%s must not be negative (got %d)", k.name, k.n)
+		}
+	}
+	return nil
+}
+
+func hourBucket(t time.Time) string  { return t.Format("2006-01-02 15") }
+func dayBucket(t time.Time) string   { return t.Format("2006-01-02") }
+func monthBucket(t time.Time) string { return t.Format("2006-01") }
+func weekBucket(t time.Time) string {
+	y, w := t.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", y, w)
+}
+
+// retentionKeep splits vers into the versions r keeps and the ones it drops
+// (both newest first).
+func retentionKeep(vers []Version, r *Retention, protected map[int]bool) (keep, drop []Version) {
+	sorted := append([]Version(nil), vers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].CreatedUnix == sorted[j].CreatedUnix {
+			return sorted[i].N > sorted[j].N
+		}
+		return sorted[i].CreatedUnix > sorted[j].CreatedUnix
+	})
+
+	kept := make([]bool, len(sorted))
+	recent := max(r.KeepLast, 1) // the newest full version is always kept
+	full := 0
+	for i, v := range sorted {
+		// Partial versions (restore's safety backups) never take the place of a
+		// full one; they are kept while they are newer than the kept full ones.
+		if full < recent || v.exempt() || protected[v.N] {
+			kept[i] = true
+		}
+		if !v.partial() {
+			full++
+		}
+	}
+	periods := []struct {
+		n      int
+		bucket func(time.Time) string
+	}{
+		{r.KeepHourly, hourBucket},
+		{r.KeepDaily, dayBucket},
+		{r.KeepWeekly, weekBucket},
+		{r.KeepMonthly, monthBucket},
+	}
+	for _, p := range periods {
+		n, last := p.n, ""
+		for i := 0; i < len(sorted) && n > 0; i++ {
+			if sorted[i].partial() {
+				continue
+			}
+			b := p.bucket(time.Unix(sorted[i].CreatedUnix, 0).Local())
+			if b == last {
+				continue
+			}
+			last = b
+			kept[i] = true
+			n--
+		}
+	}
+
+	for i, v := range sorted {
+		if kept[i] {
+			keep = append(keep, v)
+		} else {
+			drop = append(drop, v)
+		}
+	}
+	return keep, drop
+}
+
+// applyRetention deletes the versions of a project that cfg.Retention does not
+// keep and returns them.
+func applyRetention(projectRoot, project string, cfg Config, protected map[int]bool) ([]Version, error) {
+	if !cfg.Retention.enabled() {
+		return nil, nil
+	}
+	vers, err := listProjectVersions(projectRoot, project)
+	if err != nil {
+		return nil, err
+	}
+	_, drop := retentionKeep(vers, cfg.Retention, protected)
+	for i, v := range drop {
+		if err := removeVersion(v); err != nil {
+			return drop[:i], fmt.Errorf("retention: remove %s: %w", v.Path, err)
+		}
+	}
+	return drop, nil
+}
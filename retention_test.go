@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestRetentionAfterRestore checks that restore's partial safety backup does
+// not push the newest full backup out of keep_last.
+func TestRetentionAfterRestore(t *testing.T) {
+	src, root := t.TempDir(), t.TempDir()
+	cfg := Config{MaxVersions: -1, Retention: &Retention{KeepLast: 1}}
+	writeFiles(t, src, map[string]string{"a.txt": "good\n", "b.txt": "b\n"})
+
+	good, err := backupNewVersion(src, root, cfg, backupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proj, err := resolveProject(root, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := findVersion(proj.Root, proj.Name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tagVersion(proj.Root, proj.Name, cfg, v, "good"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, src, map[string]string{"a.txt": "broken\n", "c.txt": "c\n"})
+	latest, err := backupNewVersion(src, root, cfg, backupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runRestore(io.Discard, root, cfg, src, "good", []string{"a.txt"}, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	vers, err := listProjectVersions(proj.Root, proj.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := map[string]bool{}
+	partials := 0
+	for _, v := range vers {
+		have[v.Path] = true
+		if v.partial() {
+			partials++
+		}
+	}
+	if !have[good] || !have[latest] || partials != 1 || len(vers) != 3 {
+		t.Errorf("after restore: %+v; want the tagged %s, the newest full %s and one partial safety backup", vers, good, latest)
+	}
+	if nv, ok, err := newestVersion(proj.Root, proj.Name); err != nil || !ok || nv.Path != latest {
+		t.Errorf("newestVersion = %s, %v, %v; want %s", nv.Path, ok, err, latest)
+	}
+}
+
+// at returns the unix time h hours after local midnight on 2026-03-02.
+func at(h int) int64 {
+	return time.Date(2026, 3, 2, 0, 0, 0, 0, time.Local).Add(time.Duration(h) * time.Hour).Unix()
+}
+
+func versionNums(vers []Version) []int {
+	var ns []int
+	for _, v := range vers {
+		ns = append(ns, v.N)
+	}
+	return ns
+}
+
+func TestRetentionKeep(t *testing.T) {
+	full := func(n, h int) Version { return Version{N: n, CreatedUnix: at(h)} }
+	partial := func(n, h int) Version { return Version{N: n, CreatedUnix: at(h), Paths: []string{"a.txt"}} }
+	pinned := func(n, h int) Version { return Version{N: n, CreatedUnix: at(h), Pinned: true} }
+	tagged := func(n, h int) Version { return Version{N: n, CreatedUnix: at(h), Tags: []string{"good"}} }
+
+	tests := []struct {
+		name      string
+		vers      []Version
+		r         Retention
+		protected map[int]bool
+		keep      []int // newest first
+	}{
+		{"keep_last", []Version{full(1, 1), full(2, 2), full(3, 3), full(4, 4)}, Retention{KeepLast: 2}, nil, []int{4, 3}},
+		{"newest is always kept", []Version{full(1, 1), full(2, 2)}, Retention{KeepDaily: 1, KeepLast: 0}, nil, []int{2}},
+		{"order comes from the creation time", []Version{full(3, 1), full(1, 2), full(2, 3)}, Retention{KeepLast: 2}, nil, []int{2, 1}},
+		{"newest partial is not the newest",
+			[]Version{full(1, 1), full(2, 2), full(3, 3), partial(4, 4)}, Retention{KeepLast: 1}, nil, []int{4, 3}},
+		{"partial does not count toward keep_last",
+			[]Version{full(1, 1), partial(2, 2), full(3, 3), partial(4, 4), full(5, 5)}, Retention{KeepLast: 2}, nil, []int{5, 4, 3}},
+		{"partial older than keep_last goes",
+			[]Version{full(1, 1), partial(2, 2), full(3, 3), full(4, 4)}, Retention{KeepLast: 2}, nil, []int{4, 3}},
+		{"pinned and tagged are exempt",
+			[]Version{pinned(1, 1), tagged(2, 2), full(3, 3), full(4, 4)}, Retention{KeepLast: 1}, nil, []int{4, 2, 1}},
+		{"protected", []Version{full(1, 1), full(2, 2), full(3, 3)}, Retention{KeepLast: 1}, map[int]bool{1: true}, []int{3, 1}},
+		{"daily keeps each day's newest",
+			[]Version{full(1, 10), full(2, 20), full(3, 34), full(4, 44), full(5, 58)}, Retention{KeepDaily: 2}, nil, []int{5, 4}},
+		{"a partial is no day's backup",
+			[]Version{full(1, 10), full(2, 20), full(3, 34), partial(4, 44), full(5, 58)}, Retention{KeepDaily: 3}, nil, []int{5, 3, 2}},
+		{"hourly and monthly buckets overlap",
+			[]Version{full(1, 1), full(2, 2), full(3, 3), full(4, 24*40)}, Retention{KeepHourly: 2, KeepMonthly: 2}, nil, []int{4, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep, drop := retentionKeep(tt.vers, &tt.r, tt.protected)
+			if got := versionNums(keep); !reflect.DeepEqual(got, tt.keep) {
+				t.Errorf("keep = %v, want %v", got, tt.keep)
+			}
+			if len(keep)+len(drop) != len(tt.vers) {
+				t.Errorf("keep %v + drop %v do not add up to %d versions", versionNums(keep), versionNums(drop), len(tt.vers))
+			}
+		})
+	}
+}
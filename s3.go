@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// -------------------- S3 BACKEND --------------------
+//
+// A minimal S3 client (PUT/GET/HEAD/DELETE object, ListObjectsV2) signed with
+// AWS Signature V4. It speaks to AWS S3 and to S3-compatible stores such as
+// MinIO (set "path_style": true and an http(s) endpoint). Payloads are sent
+// as UNSIGNED-PAYLOAD, so uploads stream without being read twice; TLS
+// protects them in transit and encrypted backups are sealed anyway.
+
+type s3Backend struct {
+	client    *http.Client
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string // "" or "dir/" inside the bucket
+	pathStyle bool
+	accessKey string
+	secretKey string
+}
+
+func newS3Backend(c *BackendConfig) (*s3Backend, error) {
+	if c.Bucket == "" {
+		return nil, fmt.Errorf("backend.bucket is required for s3")
+	}
+	u, err := s3Endpoint(c)
+	if err != nil {
+		return nil, fmt.Errorf("backend.%w", err)
+	}
+	ak, sk := c.AccessKeyID, c.SecretAccessKey
+	if ak == "" {
+		ak = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if sk == "" {
+		sk = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if ak == "" || sk == "" {
+		return nil, fmt.Errorf("s3 credentials missing: set backend.access_key_id/secret_access_key or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY")
+	}
+	prefix := strings.Trim(c.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Backend{
+		client:    &http.Client{Timeout: 10 * time.Minute},
+		endpoint:  u,
+		region:    s3Region(c),
+		bucket:    c.Bucket,
+		prefix:    prefix,
+		pathStyle: c.PathStyle,
+		accessKey: ak,
+		secretKey: sk,
+	}, nil
+}
+
+func s3Region(c *BackendConfig) string {
+	if c.Region == "" {
+		return "us-east-1"
+	}
+	return c.Region
+}
+
+// s3Endpoint returns c's endpoint URL, by default AWS S3 in c's region. Its
+// error starts with the setting's name, for the caller to prefix.
+func s3Endpoint(c *BackendConfig) (*url.URL, error) {
+	ep := c.Endpoint
+	if ep == "" {
+		ep = "https://s3." + s3Region(c) + ".amazonaws.com"
+	}
+	u, err := url.Parse(ep)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("endpoint: invalid URL %q (expected http(s)://host[:port])", c.Endpoint)
+	}
+	return u, nil
+}
+
+func (s *s3Backend) String() string {
+	return "s3://" + s.bucket + "/" + strings.TrimSuffix(s.prefix, "/")
+}
+
+// url returns the URL of an object key (already including s.prefix), or of the
+// bucket itself when key is "".
+func (s *s3Backend) url(key string) *url.URL {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		p += "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = p + "/" + key
+	// Send the path exactly as it is signed.
+	u.RawPath = s3EscapePath(u.Path)
+	return &u
+}
+
+func (s *s3Backend) Put(key string, r io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPut, s.url(s.prefix+key), r, size)
+	if err != nil {
+		return err
+	}
+	return drain(resp, "put "+key)
+}
+
+func (s *s3Backend) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.url(s.prefix+key), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, drain(resp, "get "+key)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Backend) Stat(key string) (ObjectInfo, error) {
+	resp, err := s.do(http.MethodHead, s.url(s.prefix+key), nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := drain(resp, "stat "+key); err != nil {
+		return ObjectInfo{}, err
+	}
+	mt, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Key: key, Size: resp.ContentLength, ModTime: mt}, nil
+}
+
+func (s *s3Backend) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, s.url(s.prefix+key), nil, 0)
+	if err != nil {
+		return err
+	}
+	if err := drain(resp, "delete "+key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Backend) List(prefix string) ([]ObjectInfo, error) {
+	var out []ObjectInfo
+	token := ""
+	for {
+		u := s.url("")
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = q.Encode()
+		resp, err := s.do(http.MethodGet, u, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, drain(resp, "list "+prefix)
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		for _, c := range res.Contents {
+			mt, _ := time.Parse(time.RFC3339, c.LastModified)
+			out = append(out, ObjectInfo{Key: strings.TrimPrefix(c.Key, s.prefix), Size: c.Size, ModTime: mt})
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, nil
+}
+
+// do sends a signed request. body may be nil; size is its exact length.
+func (s *s3Backend) do(method string, u *url.URL, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s, err)
+	}
+	return resp, nil
+}
+
+// drain closes resp and turns a non-2xx status into an error (fs.ErrNotExist for 404).
+func drain(resp *http.Response, what string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", what, fs.ErrNotExist)
+	}
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return fmt.Errorf("%s: %s: %s (%s)", what, resp.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("%s: %s", what, resp.Status)
+}
+
+// -------------------- SIGV4 --------------------
+
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+func (s *s3Backend) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	canonHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + s3UnsignedPayload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonHeaders,
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	k := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	k = hmacSHA256(k, s.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except unreserved characters (RFC 3986),
+// as SigV4 requires; slashes survive only in paths.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', keepSlash && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return s3Escape(p, true)
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
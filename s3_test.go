@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func openFakeS3(t *testing.T, edit func(*BackendConfig)) (*fakeS3, *s3Backend) {
+	t.Helper()
+	f, c := newFakeS3(t)
+	if edit != nil {
+		edit(c)
+	}
+	be, err := newS3Backend(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, be
+}
+
+func getString(t *testing.T, be Backend, key string) string {
+	t.Helper()
+	b, err := readAllObject(be, key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	return string(b)
+}
+
+func TestS3BackendObjects(t *testing.T) {
+	f, be := openFakeS3(t, nil)
+	f.pageSize = 2 // make List follow continuation tokens
+
+	objects := map[string]string{
+		"p_backup/p_0/a.txt":          "alpha",
+		"p_backup/p_0/dir/b c+d.txt":  "with spaces and plus",
+		"p_backup/p_0/ünïcödé~(1).md": "unicode",
+		"p_backup/p_0/empty":          "",
+		"objects/ab/ab12":             "chunk",
+	}
+	for k, v := range objects {
+		if err := be.Put(k, strings.NewReader(v), int64(len(v))); err != nil {
+			t.Fatalf("put %s: %v", k, err)
+		}
+	}
+	for k, v := range objects {
+		if got := getString(t, be, k); got != v {
+			t.Errorf("get %s = %q, want %q", k, got, v)
+		}
+		info, err := be.Stat(k)
+		if err != nil {
+			t.Fatalf("stat %s: %v", k, err)
+		}
+		if info.Size != int64(len(v)) || info.ModTime.IsZero() {
+			t.Errorf("stat %s = %+v, want size %d and a mod time", k, info, len(v))
+		}
+	}
+
+	list, err := be.List("p_backup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, o := range list {
+		keys = append(keys, o.Key)
+	}
+	want := []string{"p_backup/p_0/a.txt", "p_backup/p_0/dir/b c+d.txt", "p_backup/p_0/empty", "p_backup/p_0/ünïcödé~(1).md"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("list = %q, want %q", keys, want)
+	}
+
+	if err := be.Delete("p_backup/p_0/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.Get("p_backup/p_0/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("get after delete: err = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := be.Stat("p_backup/p_0/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat after delete: err = %v, want fs.ErrNotExist", err)
+	}
+	if err := be.Delete("p_backup/p_0/a.txt"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
+
+func TestS3BackendPrefix(t *testing.T) {
+	f, be := openFakeS3(t, func(c *BackendConfig) { c.Prefix = "/team/bkup/" })
+	if err := be.Put("keyring.json", strings.NewReader("{}"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.keys(""); !reflect.DeepEqual(got, []string{"team/bkup/keyring.json"}) {
+		t.Errorf("stored keys = %q, want the key under the prefix", got)
+	}
+	list, err := be.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Key != "keyring.json" {
+		t.Errorf("list = %+v, want keyring.json without the prefix", list)
+	}
+	if got := be.String(); got != "s3://bkup-test/team/bkup" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestS3BackendRejected(t *testing.T) {
+	_, be := openFakeS3(t, func(c *BackendConfig) { c.SecretAccessKey = "wrong" })
+	err := be.Put("x", strings.NewReader("x"), 1)
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("put with a wrong secret: err = %v, want SignatureDoesNotMatch", err)
+	}
+
+	_, be = openFakeS3(t, func(c *BackendConfig) { c.Bucket = "other" })
+	if _, err := be.Get("x"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("get from a missing bucket: err = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestS3BackendEmptyBody(t *testing.T) {
+	_, be := openFakeS3(t, nil)
+	if err := be.Put("empty", io.LimitReader(strings.NewReader(""), 0), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := getString(t, be, "empty"); got != "" {
+		t.Errorf("get empty = %q", got)
+	}
+}
+
+func TestValidateBackend(t *testing.T) {
+	tests := []struct {
+		c    *BackendConfig
+		want string // "" = valid
+	}{
+		{nil, ""},
+		{&BackendConfig{}, ""},
+		{&BackendConfig{Type: "local"}, ""},
+		{&BackendConfig{Type: "s3", Bucket: "b"}, ""},
+		{&BackendConfig{Type: "S3", Bucket: "b", Endpoint: "http://127.0.0.1:9000"}, ""},
+		{&BackendConfig{Type: "s3"}, "stores.usb.backend.bucket is required"},
+		{&BackendConfig{Type: "s3", Bucket: "b", Endpoint: "minio:9000"}, "stores.usb.backend.endpoint: invalid URL"},
+		{&BackendConfig{Type: "ftp"}, "stores.usb.backend.type: unknown backend type"},
+	}
+	for _, tt := range tests {
+		err := validateBackend("stores.usb.backend", tt.c)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("validateBackend(%+v) = %v, want nil", tt.c, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("validateBackend(%+v) = %v, want %q", tt.c, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// -------------------- IN-PROCESS S3 --------------------
+//
+// fakeS3 is just enough of S3 for the s3 backend: path-style PUT, GET, HEAD
+// and DELETE of objects and ListObjectsV2 (paged by pageSize) on one bucket.
+// Every request must carry a valid SigV4 signature for the fake's
+// credentials; the canonical request is rebuilt from what arrived on the
+// wire, so a path or query that is sent differently from how it was signed
+// is rejected like AWS would.
+
+type fakeS3 struct {
+	bucket, region       string
+	accessKey, secretKey string
+	pageSize             int // ListObjectsV2 page size
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// newFakeS3 starts a fake and returns it with a backend config pointing at it.
+func newFakeS3(t *testing.T) (*fakeS3, *BackendConfig) {
+	t.Helper()
+	f := &fakeS3{
+		bucket:    "bkup-test",
+		region:    "eu-test-1",
+		accessKey: "AKFAKE",
+		secretKey: "fake-secret",
+		pageSize:  1000,
+		objects:   map[string]fakeObject{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, &BackendConfig{
+		Type:            "s3",
+		Endpoint:        srv.URL,
+		Region:          f.region,
+		Bucket:          f.bucket,
+		PathStyle:       true,
+		AccessKeyID:     f.accessKey,
+		SecretAccessKey: f.secretKey,
+	}
+}
+
+// keys returns the stored keys with prefix, sorted.
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rawPath, _, _ := strings.Cut(r.RequestURI, "?")
+	if code := f.checkSignature(r, rawPath); code != "" {
+		s3Error(w, http.StatusForbidden, code)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query())
+	case key == "":
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	case r.Method == http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(b)) != r.ContentLength {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = fakeObject{data: b, modTime: time.Now().UTC().Truncate(time.Second)}
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		o, ok := f.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		w.Header().Set("Last-Modified", o.modTime.Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(o.data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	type content struct {
+		Key          string `xml:"Key"`
+		Size         int    `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	}
+	var res struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, q.Get("prefix")) && k > q.Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		o := f.objects[k]
+		res.Contents = append(res.Contents, content{Key: k, Size: len(o.data), LastModified: o.modTime.Format(time.RFC3339)})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+// checkSignature verifies r's SigV4 Authorization header and returns "" or
+// the S3 error code to answer with.
+func (f *fakeS3) checkSignature(r *http.Request, rawPath string) string {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return "AccessDenied"
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(auth, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		fields[k] = v
+	}
+	cred := strings.Split(fields["Credential"], "/")
+	if len(cred) != 5 || cred[0] != f.accessKey {
+		return "InvalidAccessKeyId"
+	}
+	day, region := cred[1], cred[2]
+	amzDate := r.Header.Get("X-Amz-Date")
+	if region != f.region || cred[3] != "s3" || cred[4] != "aws4_request" || !strings.HasPrefix(amzDate, day) {
+		return "AuthorizationHeaderMalformed"
+	}
+
+	var canonHeaders strings.Builder
+	for _, h := range strings.Split(fields["SignedHeaders"], ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		canonHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	q := r.URL.Query()
+	qkeys := make([]string, 0, len(q))
+	for k := range q {
+		qkeys = append(qkeys, k)
+	}
+	sort.Strings(qkeys)
+	var query []string
+	for _, k := range qkeys {
+		for _, v := range q[k] {
+			query = append(query, awsQueryEscape(k)+"="+awsQueryEscape(v))
+		}
+	}
+	canonReq := strings.Join([]string{
+		r.Method, rawPath, strings.Join(query, "&"), canonHeaders.String(),
+		fields["SignedHeaders"], r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	k := []byte("AWS4" + f.secretKey)
+	for _, s := range []string{day, region, "s3", "aws4_request", toSign} {
+		h := hmac.New(sha256.New, k)
+		h.Write([]byte(s))
+		k = h.Sum(nil)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(k)), []byte(fields["Signature"])) {
+		return "SignatureDoesNotMatch"
+	}
+	return ""
+}
+
+// awsQueryEscape is url.QueryEscape with spaces as %20, as SigV4 wants.
+func awsQueryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: "fake s3: " + code})
+}
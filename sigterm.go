@@ -0,0 +1,19 @@
+//go:build unix || windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// stopSignals are the signals that ask bkup to stop: Ctrl-C and a plain kill.
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// signalExitCode is the status of a process killed by sig: 128+signal.
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 130
+}
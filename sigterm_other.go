@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+// stopSignals are the signals that ask bkup to stop; only Ctrl-C here.
+var stopSignals = []os.Signal{os.Interrupt}
+
+// signalExitCode is the status of an interrupted process: 128+SIGINT, as a
+// shell reports it.
+func signalExitCode(os.Signal) int { return 130 }
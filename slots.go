@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- ATOMIC SLOTS --------------------
+//
+// A version is written into a hidden temp dir next to its slot
+// (<projectRoot>/.bkup-tmp-<slot>-<pid>-<rand>), meta file last, and only then
+// swapped in: the old slot is renamed aside (.bkup-old-<slot>-<pid>-<rand>),
+// the temp dir renamed to the slot, and the old one deleted. A crash or error
+// at any point leaves either the old version or the new one in place; the
+// hidden dirs never look like versions (they lack the <project>_<n> name).
+//
+// The next backup of the project repairs an interrupted swap (see
+// recoverSlots) and deletes temp dirs whose writer is gone.
+
+const (
+	tempSlotPrefix  = ".bkup-tmp-"
+	asideSlotPrefix = ".bkup-old-"
+)
+
+// newTempSlot creates the temp dir a new version of slot dst is written into.
+func newTempSlot(dst string) (string, error) {
+	pattern := fmt.Sprintf("%s%s-%d-*", tempSlotPrefix, filepath.Base(dst), os.Getpid())
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), pattern)
+	if err != nil {
+		return "", fmt.Errorf("create temp slot: %w", err)
+	}
+	return tmp, nil
+}
+
+// commitSlot replaces dst with the complete version in tmp. Directories cannot
+// be renamed over non-empty ones, so an existing dst is moved aside first.
+func commitSlot(tmp, dst string) error {
+	aside := ""
+	if _, err := os.Lstat(dst); err == nil {
+		aside = filepath.Join(filepath.Dir(dst),
+			fmt.Sprintf("%s%s-%d-%d", asideSlotPrefix, filepath.Base(dst), os.Getpid(), time.Now().UnixNano()))
+		if err := os.Rename(dst, aside); err != nil {
+			return fmt.Errorf("move old %s aside: %w", filepath.Base(dst), err)
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		if aside != "" {
+			_ = os.Rename(aside, dst)
+		}
+		return fmt.Errorf("move new version into %s: %w", filepath.Base(dst), err)
+	}
+	if aside != "" {
+		if err := os.RemoveAll(aside); err != nil {
+			warnf("could not remove replaced version %s: %v", aside, err)
+		}
+	}
+	return nil
+}
+
+// hiddenSlot describes a temp or aside dir found in a project root.
+type hiddenSlot struct {
+	path string
+	slot string // the <project>_<n> it belongs to
+	temp bool   // a new version (else an old one moved aside)
+	pid  int
+}
+
+func parseHiddenSlot(projectRoot, name string) (hiddenSlot, bool) {
+	h := hiddenSlot{path: filepath.Join(projectRoot, name)}
+	switch {
+	case strings.HasPrefix(name, tempSlotPrefix):
+		h.temp, name = true, strings.TrimPrefix(name, tempSlotPrefix)
+	case strings.HasPrefix(name, asideSlotPrefix):
+		name = strings.TrimPrefix(name, asideSlotPrefix)
+	default:
+		return h, false
+	}
+	// <slot>-<pid>-<suffix>; the slot name may contain dashes itself.
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return h, false
+	}
+	j := strings.LastIndex(name[:i], "-")
+	if j < 0 {
+		return h, false
+	}
+	pid, err := strconv.Atoi(name[j+1 : i])
+	if err != nil {
+		return h, false
+	}
+	h.slot, h.pid = name[:j], pid
+	return h, true
+}
+
+// recoverSlots cleans up after writers that died mid-backup. For a slot left
+// empty by an interrupted swap, a complete new version is moved into place,
+// else the old one is put back. Everything else left behind is deleted.
+// Dirs of writers that are still running are left alone.
+func recoverSlots(projectRoot string) {
+	ents, err := os.ReadDir(projectRoot)
+	if err != nil {
+		return
+	}
+	var stale []hiddenSlot
+	for _, e := range ents {
+		h, ok := parseHiddenSlot(projectRoot, e.Name())
+		if !ok || !e.IsDir() || (h.pid != os.Getpid() && processAlive(h.pid)) {
+			continue
+		}
+		stale = append(stale, h)
+	}
+
+	restore := func(h hiddenSlot, what string) {
+		dst := filepath.Join(projectRoot, h.slot)
+		if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+			return
+		}
+		if err := os.Rename(h.path, dst); err != nil {
+			warnf("could not recover %s: %v", dst, err)
+			return
+		}
+		warnf("recovered %s (%s) after an interrupted backup", dst, what)
+	}
+	for _, h := range stale {
+		if _, err := os.Stat(metaPathForDir(h.path)); h.temp && err == nil {
+			restore(h, "new version")
+		}
+	}
+	for _, h := range stale {
+		if !h.temp {
+			restore(h, "previous version")
+		}
+	}
+	for _, h := range stale {
+		if _, err := os.Lstat(h.path); err == nil {
+			if err := os.RemoveAll(h.path); err != nil {
+				warnf("could not remove %s: %v", h.path, err)
+			}
+		}
+	}
+}
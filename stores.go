@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// -------------------- STORES --------------------
+//
+// config.json always lives in the config dir (layout.go); the backups it drives
+// (the backup root) can be anywhere. The root for a run is, in order:
+//   1. --root dir
+//   2. --store name: a path from the "stores" map in config.json
+//   3. $BKUP_ROOT
+//   4. the store named "default", if configured
+//   5. the data dir: $XDG_DATA_HOME/bkup, or $HOME/.bkup on macOS and Windows
+//
+// A store is a path, or {"path": ..., "backend": {...}} to mirror it to its
+// own remote; stores without one use the top-level "backend".
+
+const (
+	rootEnv          = "BKUP_ROOT"
+	defaultStoreName = "default"
+)
+
+type StoreConfig struct {
+	Path    string         `json:"path"`
+	Backend *BackendConfig `json:"backend,omitempty"`
+}
+
+// UnmarshalJSON accepts a plain path as well as the object form.
+func (s *StoreConfig) UnmarshalJSON(b []byte) error {
+	var path string
+	if err := json.Unmarshal(b, &path); err == nil {
+		*s = StoreConfig{Path: path}
+		return nil
+	}
+	type plain StoreConfig
+	return json.Unmarshal(b, (*plain)(s))
+}
+
+// MarshalJSON writes stores without a backend as plain paths.
+func (s StoreConfig) MarshalJSON() ([]byte, error) {
+	if s.Backend == nil {
+		return json.Marshal(s.Path)
+	}
+	type plain StoreConfig
+	return json.Marshal(plain(s))
+}
+
+// backupRootChoice is the backup root selected for this run.
+type backupRootChoice struct {
+	path    string
+	store   string         // store name, if chosen through the stores map
+	backend *BackendConfig // remote mirror of this root (nil = local only)
+}
+
+// selectBackupRoot picks the backup root as described above.
+func selectBackupRoot(cfg Config, root, store string) (backupRootChoice, error) {
+	if root != "" && store != "" {
+		return backupRootChoice{}, errors.New("--root and --store both choose the backup root; give one")
+	}
+	fromStore := func(name string) (backupRootChoice, error) {
+		s := cfg.Stores[name]
+		if s == nil {
+			return backupRootChoice{}, fmt.Errorf("no store named %q in config.json (stores: %s)", name, storeNames(cfg))
+		}
+		p, err := expandHome(s.Path)
+		if err != nil {
+			return backupRootChoice{}, err
+		}
+		be := cfg.Backend
+		if s.Backend != nil {
+			be = s.Backend
+		}
+		return backupRootChoice{path: p, store: name, backend: be}, nil
+	}
+
+	switch {
+	case root != "":
+		p, err := expandHome(root)
+		return backupRootChoice{path: mustAbs(p), backend: cfg.Backend}, err
+	case store != "":
+		return fromStore(store)
+	case os.Getenv(rootEnv) != "":
+		p, err := expandHome(os.Getenv(rootEnv))
+		return backupRootChoice{path: mustAbs(p), backend: cfg.Backend}, err
+	case cfg.Stores[defaultStoreName] != nil:
+		return fromStore(defaultStoreName)
+	}
+	l, err := defaultLayout()
+	return backupRootChoice{path: l.dataDir, backend: cfg.Backend}, err
+}
+
+// validateStores checks that every store has an absolute path.
+func validateStores(stores map[string]*StoreConfig) error {
+	for name, s := range stores {
+		if s == nil || strings.TrimSpace(s.Path) == "" {
+			return fmt.Errorf("stores.%s: path is empty", name)
+		}
+		p, err := expandHome(s.Path)
+		if err != nil {
+			return fmt.Errorf("stores.%s: %w", name, err)
+		}
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("stores.%s: path %q must be absolute (or start with ~/)", name, s.Path)
+		}
+	}
+	return nil
+}
+
+func storeNames(cfg Config) string {
+	if len(cfg.Stores) == 0 {
+		return "none configured"
+	}
+	return strings.Join(sortedStoreNames(cfg.Stores), ", ")
+}
+
+func sortedStoreNames(stores map[string]*StoreConfig) []string {
+	names := make([]string, 0, len(stores))
+	for n := range stores {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expandHome replaces a leading ~ with the home directory.
+func expandHome(p string) (string, error) {
+	if p != "~" && !strings.HasPrefix(p, "~/") && !strings.HasPrefix(p, `~\`) {
+		return p, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return "", errors.New("could not determine home directory")
+	}
+	return filepath.Join(home, p[1:]), nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// -------------------- WATCH COMMAND --------------------
+//
+// `bkup watch` takes a backup of the current directory whenever it settles
+// after a change:
+//   - changes come from inotify on Linux and from polling elsewhere (or when
+//     inotify is unavailable); ignored paths never count as changes
+//   - a snapshot is taken once nothing has changed for watch.quiet
+//   - snapshots are at least watch.min_interval apart, so a build storm ends
+//     up as one backup
+//   - a snapshot is skipped when the tree still matches the newest backup's
+//     manifest (e.g. a file was touched and restored)
+
+// WatchConfig is the "watch" block of config.json. Durations use Go syntax ("5s", "2m").
+type WatchConfig struct {
+	Quiet       string `json:"quiet,omitempty"`        // default 5s
+	MinInterval string `json:"min_interval,omitempty"` // default 1m
+	Poll        string `json:"poll,omitempty"`         // polling interval when inotify is unavailable, default 2s
+}
+
+type watchTimings struct {
+	quiet, minInterval, poll time.Duration
+}
+
+func (c *WatchConfig) timings() (watchTimings, error) {
+	t := watchTimings{quiet: 5 * time.Second, minInterval: time.Minute, poll: 2 * time.Second}
+	if c == nil {
+		return t, nil
+	}
+	for _, f := range []struct {
+		name string
+		raw  string
+		dst  *time.Duration
+	}{
+		{"watch.quiet", c.Quiet, &t.quiet},
+		{"watch.min_interval", c.MinInterval, &t.minInterval},
+		{"watch.poll", c.Poll, &t.poll},
+	} {
+		if f.raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.raw)
+		if err != nil || d < 0 {
+			return t, fmt.Errorf("invalid %s %q (examples: 5s, 2m)", f.name, f.raw)
+		}
+		*f.dst = d
+	}
+	if t.poll <= 0 {
+		return t, fmt.Errorf("watch.poll must be positive")
+	}
+	return t, nil
+}
+
+var errNoNativeWatcher = errors.New("no native file watching on this platform")
+
+// changeSource reports that something under the watched directory may have changed.
+type changeSource interface {
+	Changes() <-chan struct{}
+	Close() error
+}
+
+// runWatch implements `bkup watch` and returns when interrupted (SIGINT/SIGTERM).
+func runWatch(w io.Writer, backupRoot string, cfg Config, cwdAbs string, opts backupOptions) error {
+	timings, err := cfg.Watch.timings()
+	if err != nil {
+		return err
+	}
+	ign, err := loadIgnoreMatcher(cwdAbs, backupRoot, cfg)
+	if err != nil {
+		return err
+	}
+	if err := guardSource(cwdAbs, backupRoot, cfg, ign, opts.force); err != nil {
+		return err
+	}
+	proj, err := resolveProject(backupRoot, cwdAbs)
+	if err != nil {
+		return err
+	}
+	if opts.message == "" {
+		opts.message = "auto (bkup watch)"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), stopSignals...)
+	defer stop()
+
+	skip := ""
+	if insideDir(backupRoot, cwdAbs) {
+		skip = backupRoot
+	}
+	var src changeSource
+	mode := "inotify"
+	src, err = newNativeWatcher(cwdAbs, ign, skip)
+	if err != nil {
+		if !errors.Is(err, errNoNativeWatcher) {
+			warnf("%v; polling instead", err)
+		}
+		src, mode = newPollWatcher(cwdAbs, ign, timings.poll), "polling every "+timings.poll.String()
+	}
+	defer src.Close()
+
+	fmt.Fprintf(w, "Watching %s (%s; quiet %s, at most one backup per %s). Ctrl-C to stop.\n",
+		cwdAbs, mode, timings.quiet, timings.minInterval)
+
+	snapshot := func() {
+		if same, err := matchesNewest(backupRoot, cfg, proj, cwdAbs, ign); err != nil {
+			warnf("compare with newest backup: %v", err)
+		} else if same {
+			fmt.Fprintf(w, "%s  no changes since the newest backup; skipped\n", time.Now().Format("15:04:05"))
+			return
+		}
+		dst, err := backupNewVersion(cwdAbs, backupRoot, cfg, opts)
+		if err != nil {
+			// Keep watching: the next change may succeed (e.g. after `bkup prune`).
+			warnf("backup failed: %v", err)
+			return
+		}
+		fmt.Fprintf(w, "%s  %s\n", time.Now().Format("15:04:05"), dst)
+	}
+
+	var (
+		pending  bool      // a change has not been backed up yet
+		lastSnap time.Time // zero until the first snapshot
+		timer    = time.NewTimer(time.Hour)
+	)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if pending {
+				fmt.Fprintln(w, "Stopped (unsaved changes since the last backup).")
+			} else {
+				fmt.Fprintln(w, "Stopped.")
+			}
+			return nil
+
+		case _, ok := <-src.Changes():
+			if !ok {
+				return fmt.Errorf("watcher stopped unexpectedly")
+			}
+			pending = true
+			timer.Reset(timings.quiet)
+
+		case <-timer.C:
+			if !pending {
+				continue
+			}
+			if wait := timings.minInterval - time.Since(lastSnap); !lastSnap.IsZero() && wait > 0 {
+				timer.Reset(wait)
+				continue
+			}
+			pending = false
+			snapshot()
+			lastSnap = time.Now()
+		}
+	}
+}
+
+// matchesNewest reports whether the tree at srcAbs is identical (by type, mode,
+// size, mtime and symlink target) to the manifest of the project's newest backup.
+func matchesNewest(backupRoot string, cfg Config, p Project, srcAbs string, ign *ignoreMatcher) (bool, error) {
+	v, ok, err := newestVersion(p.Root, p.Name)
+	if err != nil || !ok {
+		return false, err
+	}
+	key, err := versionKey(backupRoot, cfg, v)
+	if err != nil {
+		return false, err
+	}
+	m, err := readManifest(v.Path, key)
+	if err != nil {
+		return false, nil // legacy backup without a manifest: just take a new one
+	}
+	cur, err := scanTree(srcAbs, ign)
+	if err != nil {
+		return false, err
+	}
+
+	seen := 0
+	for _, e := range m.Entries {
+		if e.Type == entryDir {
+			continue
+		}
+		c, ok := cur[e.Path]
+		if !ok || c.Type != e.Type || uint32(c.Mode) != e.Mode {
+			return false, nil
+		}
+		if e.Type == entrySymlink {
+			if c.Link != e.Link {
+				return false, nil
+			}
+		} else if c.Size != e.Size || c.MTimeNs != e.MTimeNs {
+			return false, nil
+		}
+		seen++
+	}
+	return seen == len(cur), nil
+}
+
+// -------------------- POLLING WATCHER --------------------
+
+type pollWatcher struct {
+	ch   chan struct{}
+	done chan struct{}
+}
+
+func newPollWatcher(root string, ign *ignoreMatcher, every time.Duration) *pollWatcher {
+	pw := &pollWatcher{ch: make(chan struct{}, 1), done: make(chan struct{})}
+	go func() {
+		prev, _ := scanTree(root, ign)
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-pw.done:
+				return
+			case <-t.C:
+			}
+			cur, err := scanTree(root, ign)
+			if err != nil {
+				// Files vanishing mid-walk during a build; try again next tick.
+				continue
+			}
+			if !sameScan(prev, cur) {
+				notify(pw.ch)
+			}
+			prev = cur
+		}
+	}()
+	return pw
+}
+
+func (pw *pollWatcher) Changes() <-chan struct{} { return pw.ch }
+
+func (pw *pollWatcher) Close() error {
+	close(pw.done)
+	return nil
+}
+
+func sameScan(a, b map[string]treeEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for p, x := range a {
+		y, ok := b[p]
+		if !ok || x.Type != y.Type || x.Mode != y.Mode || x.Size != y.Size || x.MTimeNs != y.MTimeNs || x.Link != y.Link {
+			return false
+		}
+	}
+	return true
+}
+
+// notify signals ch without blocking; one pending signal is enough.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// insideDir reports whether path is dir or lies below it.
+func insideDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,137 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// -------------------- INOTIFY WATCHER --------------------
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// inotifyWatcher watches every non-ignored directory under root (inotify is
+// not recursive, so new directories are added as they appear).
+type inotifyWatcher struct {
+	f    *os.File
+	fd   int
+	root string
+	ign  *ignoreMatcher
+	skip string // never watched (the backup root, if it lies inside root)
+	ch   chan struct{}
+
+	mu  sync.Mutex
+	wds map[int32]string // watch descriptor -> dir relative to root ("" for root)
+}
+
+func newNativeWatcher(root string, ign *ignoreMatcher, skip string) (changeSource, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify unavailable: %w", err)
+	}
+	w := &inotifyWatcher{
+		// A non-blocking fd goes through the runtime poller, so Close unblocks Read.
+		f:    os.NewFile(uintptr(fd), "inotify"),
+		fd:   fd,
+		root: root,
+		ign:  ign,
+		skip: skip,
+		ch:   make(chan struct{}, 1),
+		wds:  map[int32]string{},
+	}
+	if err := w.addTree(""); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.readLoop()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Changes() <-chan struct{} { return w.ch }
+
+func (w *inotifyWatcher) Close() error { return w.f.Close() }
+
+// addTree watches rel and every non-ignored directory below it.
+func (w *inotifyWatcher) addTree(rel string) error {
+	return filepath.WalkDir(filepath.Join(w.root, rel), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Vanished while walking (e.g. a build's temp dir): nothing to watch.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		r, _ := filepath.Rel(w.root, path)
+		if r == "." {
+			r = ""
+		}
+		if (r != "" && (w.ign.Match(r, true) || isInternalFile(r))) || (w.skip != "" && insideDir(path, w.skip)) {
+			return fs.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			if err == syscall.ENOSPC {
+				return fmt.Errorf("inotify watch limit reached (raise fs.inotify.max_user_watches)")
+			}
+			return nil
+		}
+		w.mu.Lock()
+		w.wds[int32(wd)] = r
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) readLoop() {
+	defer close(w.ch)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			w.handle(ev.Wd, ev.Mask, string(bytes.TrimRight(name, "\x00")))
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		notify(w.ch)
+		return
+	}
+	w.mu.Lock()
+	dir, ok := w.wds[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.wds, wd)
+	}
+	w.mu.Unlock()
+	if !ok || name == "" {
+		return
+	}
+
+	rel := filepath.Join(dir, name)
+	isDir := mask&syscall.IN_ISDIR != 0
+	if w.ign.Match(rel, isDir) || isInternalFile(rel) {
+		return
+	}
+	if isDir && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		_ = w.addTree(rel)
+	}
+	notify(w.ch)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// newNativeWatcher has no native implementation here; runWatch polls instead.
+func newNativeWatcher(root string, ign *ignoreMatcher, skip string) (changeSource, error) {
+	return nil, errNoNativeWatcher
+}